@@ -0,0 +1,9 @@
+package config
+
+// Chroot defines which users are confined to a single directory, which is their root instead of the layout.
+type Chroot struct {
+	Users  []string `yaml:"users" env:"OCSFTP_CHROOT_USERS" desc:"A comma-separated list of user names whose sessions are confined to the chroot directory." introductionVersion:"1.0.0"`
+	Groups []string `yaml:"groups" env:"OCSFTP_CHROOT_GROUPS" desc:"A comma-separated list of groups whose members are confined to the chroot directory. Groups are resolved through the gateway when a session starts." introductionVersion:"1.0.0"`
+	Space  string   `yaml:"space" env:"OCSFTP_CHROOT_SPACE" desc:"The id of the space which holds the chroot directory. If not set, the personal space of the user is used. Sessions of confined users fail if the space or the directory is not available." introductionVersion:"1.0.0"`
+	Path   string   `yaml:"path" env:"OCSFTP_CHROOT_PATH" desc:"The path of the chroot directory within the space. Defaults to the root of the space." introductionVersion:"1.0.0"`
+}
@@ -16,6 +16,13 @@ type Config struct {
 	SFTPAddress        string `yaml:"sftp_address" env:"OCSFTP_ADDRESS" desc:"The address to bind the SFTP server to. Format: 'host:port'. If not set, the server will not start." introductionVersion:"1.0.0"`
 	HostPrivateKeyPath string `yaml:"host_private_key_path" env:"OCSFTP_HOST_PRIVATE_KEY_PATH" desc:"Path to the hosts private-key" introductionVersion:"1.0.0"`
 
+	Uploads   Uploads   `yaml:"uploads"`
+	Downloads Downloads `yaml:"downloads"`
+	Setstat   Setstat   `yaml:"setstat"`
+	Layout    Layout    `yaml:"layout"`
+	Chroot    Chroot    `yaml:"chroot"`
+	Spaces    Spaces    `yaml:"spaces"`
+
 	TokenManager *TokenManager `yaml:"token_manager"`
 	Reva         *shared.Reva  `yaml:"reva"`
 
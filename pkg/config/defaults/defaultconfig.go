@@ -7,6 +7,7 @@ import (
 	"github.com/opencloud-eu/opencloud/pkg/structs"
 	"github.com/opencloud-eu/opencloud/pkg/version"
 	"path"
+	"time"
 )
 
 // FullDefaultConfig returns a fully initialized default configuration
@@ -26,7 +27,34 @@ func DefaultConfig() *config.Config {
 		SFTPAddress:        "127.0.1:2222",
 		HostPrivateKeyPath: path.Join(defaults.BaseDataPath(), "sftp", "id_rsa"),
 		Reva:               shared.DefaultRevaConfig(),
-		MachineAuthAPIKey:  "",
+		Uploads: config.Uploads{
+			TempDir:                path.Join(defaults.BaseDataPath(), "sftp", "tmp"),
+			HandleMemoryLimit:      4 << 20,
+			MemoryLimit:            256 << 20,
+			TusThreshold:           8 << 20,
+			TusChunkSize:           32 << 20,
+			Resumable:              false,
+			ResumeDir:              path.Join(defaults.BaseDataPath(), "sftp", "resume"),
+			ResumeExpiry:           24 * time.Hour,
+			StagingDir:             path.Join(defaults.BaseDataPath(), "sftp", "staging"),
+			StagingCleanupInterval: 15 * time.Minute,
+		},
+		Downloads: config.Downloads{
+			ReadAhead: 4,
+		},
+		Setstat: config.Setstat{
+			Permissions: config.SetstatIgnore,
+			Ownership:   config.SetstatIgnore,
+		},
+		Layout: config.Layout{
+			Root: config.LayoutFlat,
+		},
+		Spaces: config.Spaces{
+			Create:  true,
+			Rename:  true,
+			Disable: true,
+		},
+		MachineAuthAPIKey: "",
 		Status: config.Status{
 			Version:        version.Legacy,
 			VersionString:  version.LegacyString,
@@ -83,5 +111,22 @@ func EnsureDefaults(cfg *config.Config) {
 
 // Sanitize sanitizes the configuration
 func Sanitize(cfg *config.Config) {
-	// nothing to sanitize here atm
+	if cfg.Uploads.TusChunkSize <= 0 {
+		cfg.Uploads.TusChunkSize = DefaultConfig().Uploads.TusChunkSize
+	}
+	if cfg.Downloads.ReadAhead < 0 {
+		cfg.Downloads.ReadAhead = 0
+	}
+	if cfg.Setstat.Permissions != config.SetstatReject {
+		cfg.Setstat.Permissions = config.SetstatIgnore
+	}
+	if cfg.Setstat.Ownership != config.SetstatReject {
+		cfg.Setstat.Ownership = config.SetstatIgnore
+	}
+	cfg.Chroot.Path = path.Join("/", cfg.Chroot.Path)
+	switch cfg.Layout.Root {
+	case config.LayoutTyped, config.LayoutAlias:
+	default:
+		cfg.Layout.Root = config.LayoutFlat
+	}
 }
@@ -0,0 +1,18 @@
+package config
+
+const (
+	// LayoutFlat mounts all spaces at the root, by name
+	LayoutFlat = "flat"
+	// LayoutTyped mounts the personal space at /personal, project spaces at /projects/<name>
+	// and the received shares at /shares/<name>
+	LayoutTyped = "typed"
+	// LayoutAlias mounts spaces at their drive alias, like /personal/<user> or /project/<name>,
+	// which is kept when a space is renamed
+	LayoutAlias = "alias"
+)
+
+// Layout defines how spaces are arranged in the virtual root of a session.
+type Layout struct {
+	Root         string `yaml:"root" env:"OCSFTP_LAYOUT_ROOT" desc:"How spaces are arranged in the root directory. Valid values are: 'flat', which lists all spaces by name, 'typed', which uses '/personal', '/projects/<name>' and '/shares/<name>', and 'alias', which uses the drive aliases of the spaces. Spaces with the same name get the start of their id appended." introductionVersion:"1.0.0"`
+	ShowDisabled bool   `yaml:"show_disabled" env:"OCSFTP_LAYOUT_SHOW_DISABLED" desc:"Show disabled spaces, which are hidden by default." introductionVersion:"1.0.0"`
+}
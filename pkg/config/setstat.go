@@ -0,0 +1,14 @@
+package config
+
+const (
+	// SetstatIgnore accepts an attribute change without applying it
+	SetstatIgnore = "ignore"
+	// SetstatReject fails an attribute change as unsupported
+	SetstatReject = "reject"
+)
+
+// Setstat defines how requests to change attributes which cannot be stored in a space are handled.
+type Setstat struct {
+	Permissions string `yaml:"permissions" env:"OCSFTP_SETSTAT_PERMISSIONS" desc:"How requests to change the permissions of a file are handled. Valid values are: 'ignore', which accepts them without effect, and 'reject', which fails them as unsupported." introductionVersion:"1.0.0"`
+	Ownership   string `yaml:"ownership" env:"OCSFTP_SETSTAT_OWNERSHIP" desc:"How requests to change the owner or group of a file are handled. Valid values are: 'ignore', which accepts them without effect, and 'reject', which fails them as unsupported." introductionVersion:"1.0.0"`
+}
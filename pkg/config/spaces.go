@@ -0,0 +1,9 @@
+package config
+
+// Spaces defines which changes to project spaces can be made in the root directory. Each of them
+// is also subject to the permissions of the user, which are checked by the storage provider.
+type Spaces struct {
+	Create  bool `yaml:"create" env:"OCSFTP_SPACES_CREATE" desc:"Allow creating a project space by creating a directory where project spaces are mounted, like '/<name>' in the flat layout or '/projects/<name>' in the typed layout." introductionVersion:"1.0.0"`
+	Rename  bool `yaml:"rename" env:"OCSFTP_SPACES_RENAME" desc:"Allow renaming a project space by renaming its directory in the root." introductionVersion:"1.0.0"`
+	Disable bool `yaml:"disable" env:"OCSFTP_SPACES_DISABLE" desc:"Allow disabling an empty project space by removing its directory in the root." introductionVersion:"1.0.0"`
+}
@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+// Uploads defines how file content written by clients is buffered before it is uploaded.
+type Uploads struct {
+	TempDir           string `yaml:"temp_dir" env:"OCSFTP_UPLOADS_TEMP_DIR" desc:"Directory for temporary files holding uploads which exceed the memory limits. Leftover files are removed when the service starts." introductionVersion:"1.0.0"`
+	HandleMemoryLimit int64  `yaml:"handle_memory_limit" env:"OCSFTP_UPLOADS_HANDLE_MEMORY_LIMIT" desc:"Maximum number of bytes of a single upload kept in memory. Larger uploads are spilled to a temporary file. Set to 0 to always use temporary files." introductionVersion:"1.0.0"`
+	MemoryLimit       int64  `yaml:"memory_limit" env:"OCSFTP_UPLOADS_MEMORY_LIMIT" desc:"Maximum number of bytes kept in memory by all uploads together. Uploads which do not fit are spilled to temporary files." introductionVersion:"1.0.0"`
+	TusThreshold      int64  `yaml:"tus_threshold" env:"OCSFTP_UPLOADS_TUS_THRESHOLD" desc:"Uploads of at least this many bytes are sent to the data gateway in chunks using TUS. Smaller uploads use a single PUT request." introductionVersion:"1.0.0"`
+	TusChunkSize      int64  `yaml:"tus_chunk_size" env:"OCSFTP_UPLOADS_TUS_CHUNK_SIZE" desc:"Size in bytes of the chunks sent with TUS." introductionVersion:"1.0.0"`
+
+	Resumable    bool          `yaml:"resumable" env:"OCSFTP_UPLOADS_RESUMABLE" desc:"Keep the content of uploads interrupted by a dropped connection, so that clients can resume them in a later session, e.g. with 'reput'. Stat requests report the size received so far for such files, while their stored content stays unchanged until the upload is completed." introductionVersion:"1.0.0"`
+	ResumeDir    string        `yaml:"resume_dir" env:"OCSFTP_UPLOADS_RESUME_DIR" desc:"Directory for the content of interrupted uploads. Unlike the temp dir it is kept across restarts." introductionVersion:"1.0.0"`
+	ResumeExpiry time.Duration `yaml:"resume_expiry" env:"OCSFTP_UPLOADS_RESUME_EXPIRY" desc:"Time after which an interrupted upload that has not been resumed is dropped. Set to 0 to keep interrupted uploads indefinitely." introductionVersion:"1.0.0"`
+
+	Atomic                 bool          `yaml:"atomic" env:"OCSFTP_UPLOADS_ATOMIC" desc:"Upload to a hidden temporary file next to the target and move it onto the target when the client closes the file, so other clients never see partially written content." introductionVersion:"1.0.0"`
+	StagingDir             string        `yaml:"staging_dir" env:"OCSFTP_UPLOADS_STAGING_DIR" desc:"Directory where hidden temporary files of atomic uploads are recorded while they exist, so that those left behind by a crash can be removed." introductionVersion:"1.0.0"`
+	StagingCleanupInterval time.Duration `yaml:"staging_cleanup_interval" env:"OCSFTP_UPLOADS_STAGING_CLEANUP_INTERVAL" desc:"Interval in which the removal of left behind temporary files of atomic uploads is retried. Set to 0 to only remove them when the service starts." introductionVersion:"1.0.0"`
+}
+
+// Downloads defines how file content is fetched from the data gateway for reading clients.
+type Downloads struct {
+	ReadAhead int `yaml:"read_ahead" env:"OCSFTP_DOWNLOADS_READ_AHEAD" desc:"Number of 1 MiB blocks fetched concurrently ahead of a client which reads a file sequentially. Set to 0 to disable read-ahead." introductionVersion:"1.0.0"`
+}
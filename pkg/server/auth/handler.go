@@ -57,6 +57,7 @@ func (h *pubKeyAuthHandler) HandlePubKey(ctx ssh.Context, key ssh.PublicKey) boo
 		if ssh.KeysEqual(storedKey, key) {
 			ctx.SetValue("uid", authRes.GetUser().GetId())
 			ctx.SetValue("token", authRes.GetToken())
+			ctx.SetValue("groups", authRes.GetUser().GetGroups())
 			return true
 		}
 	}
@@ -137,7 +137,7 @@ func (p *SpaceKeyStorage) LoadKeys(ctx context.Context, userName string) ([]ssh.
 		}
 
 		// Download the public key file
-		pubKey, err := p.downloadPublicKey(ctx, resourceID, fileName, token)
+		pubKey, err := p.downloadPublicKey(ctx, &resourceID, fileName, token)
 		if err != nil {
 			p.log.Warn().Err(err).Str("file", fileName).Str("user", userName).Msg("Failed to download or parse public key file")
 			continue
@@ -150,7 +150,7 @@ func (p *SpaceKeyStorage) LoadKeys(ctx context.Context, userName string) ([]ssh.
 	return publicKeys, nil
 }
 
-func (p *SpaceKeyStorage) downloadPublicKey(ctx context.Context, resourceID providerv1beta1.ResourceId, fileName string, token string) (ssh.PublicKey, error) {
+func (p *SpaceKeyStorage) downloadPublicKey(ctx context.Context, resourceID *providerv1beta1.ResourceId, fileName string, token string) (ssh.PublicKey, error) {
 	gwapi, err := p.gwSelector.Next()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get gateway client: %w", err)
@@ -160,7 +160,7 @@ func (p *SpaceKeyStorage) downloadPublicKey(ctx context.Context, resourceID prov
 	fdres, err := gwapi.InitiateFileDownload(ctx, &providerv1beta1.InitiateFileDownloadRequest{
 		Opaque: nil,
 		Ref: &providerv1beta1.Reference{
-			ResourceId: &resourceID,
+			ResourceId: resourceID,
 			Path:       utils.MakeRelativePath(filepath.Join("/.ssh", fileName)),
 		},
 	})
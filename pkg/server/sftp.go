@@ -4,6 +4,7 @@ import (
 	"context"
 	sftpSvrCfg "github.com/IljaN/opencloud-sftp/pkg/config"
 	"github.com/IljaN/opencloud-sftp/pkg/server/auth"
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
 	"github.com/IljaN/opencloud-sftp/pkg/vfs"
 	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
@@ -23,6 +24,7 @@ type SFTPServer struct {
 	*ssh.Server
 
 	gwSelector *pool.Selector[gateway.GatewayAPIClient]
+	vfs        *vfs.OpenCloudFS
 	cfg        *sftpSvrCfg.Config
 	log        log.Logger
 }
@@ -39,35 +41,34 @@ func NewSFTPServer(cfg *sftpSvrCfg.Config, logger log.Logger) *SFTPServer {
 	s.SubsystemHandlers = map[string]ssh.SubsystemHandler{
 		"sftp": s.SFTPHandler,
 	}
+	s.Handler = s.ExecHandler
 
 	return s
 }
 
 // SFTPHandler handler for SFTP subsystem
 func (s *SFTPServer) SFTPHandler(sess ssh.Session) {
-	uid, ok := sess.Context().Value("uid").(*userpb.UserId)
+	authCtx, ok := s.authContext(sess)
 	if !ok {
-		s.log.Error().Msg("Failed to get uid from ctx")
 		return
 	}
 
-	token, ok := sess.Context().Value("token").(string)
-	if !ok {
-		s.log.Error().Msg("Failed to get token from ctx")
-		return
-	}
-
-	authCtx := ctxpkg.ContextSetUser(context.Background(), &userpb.User{Id: uid})
-	authCtx = metadata.AppendToOutgoingContext(authCtx, ctxpkg.TokenHeader, token)
-
 	vfsLogger := s.log.With().
 		Str("subsystem", "vfs").
 		Str("uid", sess.User()).
 		Logger()
 
+	session, err := s.vfs.Handler(authCtx, vfsLogger)
+	if err != nil {
+		vfsLogger.Error().Err(err).Msg("Could not start the sftp session")
+		return
+	}
+
+	conn := sftpext.NewConn(sess, session.Home, session.Extensions, vfsLogger)
 	server := sftp.NewRequestServer(
-		sess,
-		vfs.OpenCloudHandler(authCtx, s.gwSelector, vfsLogger),
+		conn,
+		conn.Handlers(session.Handlers),
+		sftp.WithStartDirectory(session.Home),
 	)
 
 	if err := server.Serve(); err == io.EOF {
@@ -78,6 +79,46 @@ func (s *SFTPServer) SFTPHandler(sess ssh.Session) {
 	}
 }
 
+// ExecHandler handles exec requests and shells, only the hash commands of the vfs can be run
+func (s *SFTPServer) ExecHandler(sess ssh.Session) {
+	authCtx, ok := s.authContext(sess)
+	if !ok {
+		sess.Exit(1)
+		return
+	}
+
+	vfsLogger := s.log.With().
+		Str("subsystem", "exec").
+		Str("uid", sess.User()).
+		Logger()
+
+	status := s.vfs.Exec(authCtx, vfsLogger, sess.Command(), sess, sess, sess.Stderr())
+	if err := sess.Exit(status); err != nil {
+		s.log.Debug().Str("uid", sess.User()).Err(err).Msg("could not send exit status")
+	}
+}
+
+// authContext returns the context for gateway requests on behalf of the user of the session
+func (s *SFTPServer) authContext(sess ssh.Session) (context.Context, bool) {
+	uid, ok := sess.Context().Value("uid").(*userpb.UserId)
+	if !ok {
+		s.log.Error().Msg("Failed to get uid from ctx")
+		return nil, false
+	}
+
+	token, ok := sess.Context().Value("token").(string)
+	if !ok {
+		s.log.Error().Msg("Failed to get token from ctx")
+		return nil, false
+	}
+
+	groups, _ := sess.Context().Value("groups").([]string)
+
+	authCtx := ctxpkg.ContextSetUser(context.Background(), &userpb.User{Id: uid, Username: sess.User(), Groups: groups})
+	authCtx = metadata.AppendToOutgoingContext(authCtx, ctxpkg.TokenHeader, token)
+	return authCtx, true
+}
+
 func (s *SFTPServer) ListenAndServe() error {
 	key, err := readPrivateKeyFromFile(s.cfg.HostPrivateKeyPath)
 	if err != nil {
@@ -98,6 +139,11 @@ func (s *SFTPServer) ListenAndServe() error {
 
 	s.gwSelector = sel
 
+	s.vfs, err = vfs.NewOpenCloudFS(s.cfg, s.gwSelector, s.log.Logger)
+	if err != nil {
+		return err
+	}
+
 	s.PublicKeyHandler = auth.NewPubKeyAuthHandler(
 		auth.NewSpaceKeyStorage(s.cfg, s.gwSelector, s.log),
 		s.gwSelector,
@@ -0,0 +1,328 @@
+// Package sftpext adds extended requests to sftp sessions which pkg/sftp does not know about.
+// It sits between the ssh channel and the request server, answers the registered extended
+// requests itself and passes all other packets on.
+package sftpext
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// maxPacketSize bounds the packets read from the client, it matches the limit of pkg/sftp
+const maxPacketSize = 256 * 1024
+
+// Extension is an extended request answered outside the request server
+type Extension struct {
+	// Name is the extension name, as sent by the client and advertised in the version reply
+	Name string
+	// Data is advertised along with the name, usually the version of the extension
+	Data string
+	// Handle answers a request. It returns the data of an extended reply,
+	// or nil to reply with a status.
+	Handle func(req *Request) ([]byte, error)
+	// Path answers requests which are replied to with a single name, like realpath requests.
+	// It is used instead of Handle if set.
+	Path func(req *Request) (string, error)
+}
+
+// Conn wraps the channel of an sftp session and is handed to the request server in its place
+type Conn struct {
+	rwc  io.ReadWriteCloser
+	exts []Extension
+	log  zerolog.Logger
+	// startDirectory is the base of relative paths, as passed to the request server
+	startDirectory string
+
+	handles *handleTable
+
+	// in holds the rest of the packet being read by the request server
+	in []byte
+
+	wmu sync.Mutex
+	// out collects the packet being written by the request server
+	out []byte
+}
+
+// NewConn wraps rwc and answers the given extended requests. Relative paths are resolved
+// against startDirectory, which has to match the start directory of the request server.
+func NewConn(rwc io.ReadWriteCloser, startDirectory string, exts []Extension, logger zerolog.Logger) *Conn {
+	return &Conn{
+		rwc:            rwc,
+		exts:           exts,
+		log:            logger,
+		startDirectory: cleanPath("/", startDirectory),
+		handles:        newHandleTable(),
+	}
+}
+
+// Read implements io.Reader. It passes packets from the client to the request server, except
+// for the extended requests which are answered by the registered extensions.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+
+		if !c.intercept(pkt[4:]) {
+			c.in = pkt
+		}
+	}
+
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// Write implements io.Writer. It collects the packets written by the request server, so that
+// they are sent to the client as a whole and do not interleave with replies of extensions.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.out = append(c.out, p...)
+
+	for len(c.out) >= 4 {
+		end := 4 + int(binary.BigEndian.Uint32(c.out))
+		if len(c.out) < end {
+			break
+		}
+
+		pkt := c.inspect(c.out[:end])
+		if _, err := c.rwc.Write(pkt); err != nil {
+			return 0, err
+		}
+
+		c.out = c.out[end:]
+	}
+
+	if len(c.out) == 0 {
+		c.out = nil
+	}
+
+	return len(p), nil
+}
+
+// Close implements io.Closer
+func (c *Conn) Close() error {
+	return c.rwc.Close()
+}
+
+// readPacket reads the next packet from the client, including its length prefix
+func (c *Conn) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.rwc, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > maxPacketSize {
+		return nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	pkt := make([]byte, 4+length)
+	copy(pkt, header[:])
+	if _, err := io.ReadFull(c.rwc, pkt[4:]); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// intercept inspects a packet sent by the client. It returns true if the packet has been taken over
+// by an extension and must not be passed to the request server.
+func (c *Conn) intercept(body []byte) bool {
+	id, rest, ok := readUint32(body[1:])
+	if !ok {
+		return false
+	}
+
+	switch body[0] {
+	case fxpOpen:
+		if filename, _, ok := readString(rest); ok {
+			c.handles.opening(id, cleanPath(c.startDirectory, filename))
+		}
+	case fxpClose:
+		if handle, _, ok := readString(rest); ok {
+			c.handles.close(handle)
+		}
+	case fxpExtended:
+		name, data, ok := readString(rest)
+		if !ok {
+			return false
+		}
+
+		ext, ok := c.extension(name)
+		if !ok {
+			return false
+		}
+
+		// extensions may take long, like server side copies, and must not hold up other requests
+		go c.serve(ext, &Request{ID: id, Name: name, data: data, handles: c.handles, startDirectory: c.startDirectory})
+		return true
+	}
+
+	return false
+}
+
+// inspect looks at a packet written by the request server and returns the packet to send to the client.
+// Handles are recorded, and the registered extensions are added to the version reply.
+func (c *Conn) inspect(pkt []byte) []byte {
+	body := pkt[4:]
+	if len(body) == 0 {
+		return pkt
+	}
+
+	switch body[0] {
+	case fxpVersion:
+		version := append([]byte(nil), body...)
+		for _, ext := range c.exts {
+			version = AppendString(version, ext.Name)
+			version = AppendString(version, ext.Data)
+		}
+		return frame(version)
+	case fxpHandle:
+		if id, rest, ok := readUint32(body[1:]); ok {
+			if handle, _, ok := readString(rest); ok {
+				c.handles.opened(id, handle)
+			}
+		}
+	case fxpStatus:
+		if id, _, ok := readUint32(body[1:]); ok {
+			c.handles.failed(id)
+		}
+	}
+
+	return pkt
+}
+
+// extension returns the registered extension with the given name
+func (c *Conn) extension(name string) (Extension, bool) {
+	for _, ext := range c.exts {
+		if ext.Name == name {
+			return ext, true
+		}
+	}
+
+	return Extension{}, false
+}
+
+// serve answers an extended request
+func (c *Conn) serve(ext Extension, req *Request) {
+	var reply []byte
+	var err error
+	if ext.Path != nil {
+		var name string
+		if name, err = ext.Path(req); err != nil {
+			reply = statusPacket(req.ID, err)
+		} else {
+			reply = namePacket(req.ID, name)
+		}
+	} else {
+		var data []byte
+		if data, err = ext.Handle(req); err != nil || data == nil {
+			reply = statusPacket(req.ID, err)
+		} else {
+			reply = extendedReplyPacket(req.ID, data)
+		}
+	}
+
+	if err != nil {
+		c.log.Debug().
+			Err(err).
+			Str("extension", req.Name).
+			Msg("Extended request failed")
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.rwc.Write(reply); err != nil {
+		c.log.Debug().Err(err).Str("extension", req.Name).Msg("Could not send extended reply")
+	}
+}
+
+// openFile is a file opened by the request server
+type openFile struct {
+	path string
+	// file is what the handlers returned for it, nil if they are not wrapped by Conn.Handlers
+	file any
+}
+
+// handleTable tracks the paths of the handles handed out by the request server
+type handleTable struct {
+	mu sync.Mutex
+	// pending holds the paths of open requests by request id, until the server replies
+	pending map[uint32]string
+	// files holds the files returned by the handlers until their handles are replied.
+	// The request server processes open requests one at a time and replies in order,
+	// so the next handle replied to an open request belongs to the first file.
+	files   []any
+	handles map[string]openFile
+}
+
+func newHandleTable() *handleTable {
+	return &handleTable{
+		pending: map[uint32]string{},
+		handles: map[string]openFile{},
+	}
+}
+
+// returned records a file returned by the handlers for an open request
+func (t *handleTable) returned(file any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.files = append(t.files, file)
+}
+
+func (t *handleTable) opening(id uint32, p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[id] = p
+}
+
+func (t *handleTable) opened(id uint32, handle string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.pending[id]
+	if !ok {
+		return
+	}
+	delete(t.pending, id)
+
+	f := openFile{path: p}
+	if len(t.files) > 0 {
+		f.file = t.files[0]
+		t.files = t.files[1:]
+	}
+	t.handles[handle] = f
+}
+
+func (t *handleTable) failed(id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, id)
+}
+
+func (t *handleTable) close(handle string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.handles, handle)
+}
+
+func (t *handleTable) file(handle string) (openFile, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.handles[handle]
+	return f, ok
+}
@@ -0,0 +1,64 @@
+package sftpext
+
+import (
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// Handlers wraps the handlers of the request server, so that the files they open are recorded
+// and extensions can look them up by handle through Request.File
+func (c *Conn) Handlers(h sftp.Handlers) sftp.Handlers {
+	h.FileGet = &fileReader{FileReader: h.FileGet, handles: c.handles}
+
+	w := fileWriter{FileWriter: h.FilePut, handles: c.handles}
+	if ow, ok := h.FilePut.(sftp.OpenFileWriter); ok {
+		h.FilePut = &openFileWriter{fileWriter: w, open: ow}
+	} else {
+		h.FilePut = &w
+	}
+
+	return h
+}
+
+type fileReader struct {
+	sftp.FileReader
+	handles *handleTable
+}
+
+func (r *fileReader) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	f, err := r.FileReader.Fileread(req)
+	if err == nil {
+		r.handles.returned(f)
+	}
+
+	return f, err
+}
+
+type fileWriter struct {
+	sftp.FileWriter
+	handles *handleTable
+}
+
+func (w *fileWriter) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	f, err := w.FileWriter.Filewrite(req)
+	if err == nil {
+		w.handles.returned(f)
+	}
+
+	return f, err
+}
+
+type openFileWriter struct {
+	fileWriter
+	open sftp.OpenFileWriter
+}
+
+func (w *openFileWriter) OpenFile(req *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := w.open.OpenFile(req)
+	if err == nil {
+		w.handles.returned(f)
+	}
+
+	return f, err
+}
@@ -0,0 +1,228 @@
+package sftpext
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPv3 packet types which are inspected or answered
+const (
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpName          = 104
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// SFTPv3 status codes
+const (
+	fxOK            = 0
+	fxEOF           = 1
+	fxNoSuchFile    = 2
+	fxPermission    = 3
+	fxFailure       = 4
+	fxOpUnsupported = 8
+)
+
+// ErrBadHandle is returned for handles which do not belong to an open file
+var ErrBadHandle = errors.New("invalid handle")
+
+// errShortPacket is returned when a packet ends before all of its fields have been read
+var errShortPacket = errors.New("packet too short")
+
+// Request is an extended request sent by the client
+type Request struct {
+	ID   uint32
+	Name string
+
+	// data holds the request specific fields which have not been read yet
+	data    []byte
+	handles *handleTable
+	// startDirectory is the base of relative paths
+	startDirectory string
+}
+
+// String reads a string field
+func (r *Request) String() (string, error) {
+	if len(r.data) < 4 {
+		return "", errShortPacket
+	}
+
+	n := binary.BigEndian.Uint32(r.data)
+	if uint64(len(r.data)-4) < uint64(n) {
+		return "", errShortPacket
+	}
+
+	s := string(r.data[4 : 4+n])
+	r.data = r.data[4+n:]
+	return s, nil
+}
+
+// Uint32 reads a uint32 field
+func (r *Request) Uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errShortPacket
+	}
+
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+// Uint64 reads a uint64 field
+func (r *Request) Uint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, errShortPacket
+	}
+
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+// Bool reads a boolean field
+func (r *Request) Bool() (bool, error) {
+	if len(r.data) < 1 {
+		return false, errShortPacket
+	}
+
+	v := r.data[0] != 0
+	r.data = r.data[1:]
+	return v, nil
+}
+
+// Path reads a path field and cleans it the way the request server does,
+// relative paths are resolved against the start directory
+func (r *Request) Path() (string, error) {
+	p, err := r.String()
+	if err != nil {
+		return "", err
+	}
+
+	return cleanPath(r.startDirectory, p), nil
+}
+
+// Handle reads a handle field and returns the path of the file it has been opened for
+func (r *Request) Handle() (string, error) {
+	p, _, err := r.File()
+	return p, err
+}
+
+// File reads a handle field and returns the path of the file it has been opened for, along with
+// the file returned by the handlers. The file is nil unless the handlers are wrapped by Conn.Handlers.
+func (r *Request) File() (string, any, error) {
+	handle, err := r.String()
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, ok := r.handles.file(handle)
+	if !ok {
+		return "", nil, ErrBadHandle
+	}
+
+	return f.path, f.file, nil
+}
+
+// cleanPath turns p into an absolute, clean path, relative paths start at base
+func cleanPath(base, p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+
+	return path.Join(base, p)
+}
+
+// appendUint32 appends a uint32 field
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+// AppendString appends a string field, for building the data of extended replies
+func AppendString(b []byte, s string) []byte {
+	b = appendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// readUint32 reads a uint32 at the start of b
+func readUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, b, false
+	}
+
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+// readString reads a string at the start of b
+func readString(b []byte) (string, []byte, bool) {
+	n, rest, ok := readUint32(b)
+	if !ok || uint64(len(rest)) < uint64(n) {
+		return "", b, false
+	}
+
+	return string(rest[:n]), rest[n:], true
+}
+
+// frame prefixes a packet body with its length
+func frame(body []byte) []byte {
+	return append(appendUint32(make([]byte, 0, 4+len(body)), uint32(len(body))), body...)
+}
+
+// statusPacket returns the status reply to request id for err
+func statusPacket(id uint32, err error) []byte {
+	code, msg := uint32(fxOK), "OK"
+	if err != nil {
+		code, msg = statusCode(err), err.Error()
+	}
+
+	b := []byte{fxpStatus}
+	b = appendUint32(b, id)
+	b = appendUint32(b, code)
+	b = AppendString(b, msg)
+	b = AppendString(b, "en")
+	return frame(b)
+}
+
+// extendedReplyPacket returns the extended reply to request id carrying data
+func extendedReplyPacket(id uint32, data []byte) []byte {
+	b := []byte{fxpExtendedReply}
+	b = appendUint32(b, id)
+	return frame(append(b, data...))
+}
+
+// namePacket returns the reply to request id carrying a single name, as sent for realpath requests
+func namePacket(id uint32, name string) []byte {
+	b := []byte{fxpName}
+	b = appendUint32(b, id)
+	b = appendUint32(b, 1)
+	b = AppendString(b, name)
+	// the long name, and attributes without any flags
+	b = AppendString(b, name)
+	b = appendUint32(b, 0)
+	return frame(b)
+}
+
+// statusCode maps an error to an SFTPv3 status code
+func statusCode(err error) uint32 {
+	switch {
+	case errors.Is(err, io.EOF):
+		return fxEOF
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENOENT):
+		return fxNoSuchFile
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fxPermission
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		return fxOpUnsupported
+	default:
+		return fxFailure
+	}
+}
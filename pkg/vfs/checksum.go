@@ -0,0 +1,206 @@
+package vfs
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// minCheckBlockSize is the smallest block size accepted by check-file, as required by the extension draft
+	minCheckBlockSize = 256
+	// maxCheckFileReply bounds the hashes sent in one check-file reply, so that it fits into a packet
+	maxCheckFileReply = 250 * 1024
+)
+
+// checksumAlgorithms are the hash algorithms supported by check-file. The storage provider keeps checksums
+// of the whole file for all of them, which are used instead of reading the content when possible.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":    sha1.New,
+	"md5":     md5.New,
+	"adler32": func() hash.Hash { return adler32.New() },
+}
+
+// handleCheckFileName handles check-file-name requests, which hash a range of the file at a path
+func (fs *root) handleCheckFileName(req *sftpext.Request) ([]byte, error) {
+	p, err := req.Path()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.checkFile(req, p, nil)
+}
+
+// handleCheckFileHandle handles check-file-handle requests, which hash a range of an open file
+func (fs *root) handleCheckFileHandle(req *sftpext.Request) ([]byte, error) {
+	p, file, err := req.File()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.checkFile(req, p, file)
+}
+
+// checkFile answers a check-file request for the file at p. The client lists the algorithms it accepts, the
+// first one supported is used. The range starting at offset is hashed in blocks of blockSize bytes, a length
+// of zero extends to the end of the file and a block size of zero hashes the range as a whole.
+// file is what has been opened for the handle of a check-file-handle request, nil for check-file-name.
+func (fs *root) checkFile(req *sftpext.Request, p string, file any) ([]byte, error) {
+	algorithms, err := req.String()
+	if err != nil {
+		return nil, err
+	}
+	offset, err := req.Uint64()
+	if err != nil {
+		return nil, err
+	}
+	length, err := req.Uint64()
+	if err != nil {
+		return nil, err
+	}
+	blockSize, err := req.Uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.log.Debug().
+		Str("path", p).
+		Str("algorithms", algorithms).
+		Uint64("offset", offset).
+		Uint64("length", length).
+		Uint32("block-size", blockSize).
+		Msg("check-file called")
+
+	algo := pickChecksumAlgorithm(algorithms)
+	if algo == "" {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	if offset > math.MaxInt64 || length > math.MaxInt64 || (blockSize != 0 && blockSize < minCheckBlockSize) {
+		return nil, os.ErrInvalid
+	}
+
+	var r io.ReaderAt
+	var info *provider.ResourceInfo
+	var release func()
+	if file != nil {
+		r, info, release, err = fs.handleReader(p, file)
+	} else {
+		r, info, release, err = fs.contentReader(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	reply := sftpext.AppendString(nil, "check-file")
+	reply = sftpext.AppendString(reply, algo)
+
+	// info is only missing for files written in this session, whose stored checksums are stale
+	if info != nil && offset == 0 {
+		size := info.GetSize()
+		whole := (length == 0 || length >= size) && (blockSize == 0 || uint64(blockSize) >= size)
+		if sum := storedChecksum(info, algo); whole && sum != nil {
+			return append(reply, sum...), nil
+		}
+	}
+
+	if length == 0 {
+		length = uint64(math.MaxInt64) - offset
+	}
+
+	sums, err := hashBlocks(io.NewSectionReader(r, int64(offset), int64(length)), checksumAlgorithms[algo], int64(blockSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(reply, sums...), nil
+}
+
+// pickChecksumAlgorithm returns the first algorithm of the comma separated list which is supported
+func pickChecksumAlgorithm(list string) string {
+	for _, algo := range strings.Split(list, ",") {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if _, ok := checksumAlgorithms[algo]; ok {
+			return algo
+		}
+	}
+
+	return ""
+}
+
+// storedChecksum returns the checksum of the whole file kept by the storage provider, or nil if there is
+// none for algo. The sha1 sum is carried in the resource info itself, others in its opaque map.
+func storedChecksum(info *provider.ResourceInfo, algo string) []byte {
+	var sum string
+	switch {
+	case algo == "sha1" && info.GetChecksum().GetType() == provider.ResourceChecksumType_RESOURCE_CHECKSUM_TYPE_SHA1:
+		sum = info.GetChecksum().GetSum()
+	default:
+		if entry, ok := info.GetOpaque().GetMap()[algo]; ok && entry.GetDecoder() == "plain" {
+			sum = string(entry.GetValue())
+		}
+	}
+
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+
+	return b
+}
+
+// hashBlocks hashes the content of r in blocks of blockSize bytes and returns the concatenated sums.
+// A block size of zero hashes the content as a whole. At least one sum is returned, also for empty content.
+func hashBlocks(r io.Reader, newHash func() hash.Hash, blockSize int64) ([]byte, error) {
+	if blockSize == 0 {
+		blockSize = math.MaxInt64
+	}
+
+	var sums []byte
+	for {
+		h := newHash()
+		n, err := io.CopyN(h, r, blockSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if n > 0 || len(sums) == 0 {
+			sums = h.Sum(sums)
+		}
+		if n < blockSize {
+			return sums, nil
+		}
+		if len(sums) > maxCheckFileReply {
+			return nil, errors.New("too many blocks to hash, use a larger block size")
+		}
+	}
+}
+
+// fileChecksum returns the algo checksum of the whole file at p, preferring the one kept by the storage provider
+func (fs *root) fileChecksum(p, algo string) ([]byte, error) {
+	r, info, release, err := fs.contentReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if info != nil {
+		if sum := storedChecksum(info, algo); sum != nil {
+			return sum, nil
+		}
+	}
+
+	return hashBlocks(io.NewSectionReader(r, 0, math.MaxInt64), checksumAlgorithms[algo], 0)
+}
@@ -0,0 +1,113 @@
+package vfs
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// chrootFor returns the chroot configuration if it applies to the user, by name or by one of its groups
+func chrootFor(cfg config.Chroot, username string, groups []string) *config.Chroot {
+	if slices.Contains(cfg.Users, username) {
+		return &cfg
+	}
+
+	for _, group := range groups {
+		if slices.Contains(cfg.Groups, group) {
+			return &cfg
+		}
+	}
+
+	return nil
+}
+
+// setChroot confines the session to the chroot directory if the configuration applies to the user.
+// The session fails if the directory is not available, rather than showing an empty root because of
+// a mistyped space id or path.
+func (fs *root) setChroot(cfg config.Chroot, user *userpb.User) error {
+	groups := user.GetGroups()
+	if len(cfg.Groups) > 0 && !slices.Contains(cfg.Users, user.GetUsername()) {
+		// the groups of the login are not filled in by every user provider
+		resolved, err := fs.userGroups(user.GetId())
+		if err != nil {
+			fs.log.Debug().Err(err).Msg("Could not resolve the groups of the user, using the groups of the login")
+		} else {
+			groups = resolved
+		}
+	}
+
+	fs.chroot = chrootFor(cfg, user.GetUsername(), groups)
+	if fs.chroot == nil {
+		return nil
+	}
+
+	spaces, err := fs.listStorageSpaces()
+	if err != nil {
+		return err
+	}
+
+	mounts := fs.chrootMounts(spaces)
+	if len(mounts) == 0 {
+		if cfg.Space == "" {
+			return fmt.Errorf("chroot: the personal space of %s is not available", user.GetUsername())
+		}
+		return fmt.Errorf("chroot: the space %s is not available", cfg.Space)
+	}
+
+	ref, err := spacelookup.MakeStorageSpaceReference(mounts[0].space.GetId().GetOpaqueId(), mounts[0].base)
+	if err != nil {
+		return err
+	}
+
+	info, err := fs.statRef(&ref)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return fmt.Errorf("chroot: the directory %s does not exist", cfg.Path)
+	}
+
+	return nil
+}
+
+// userGroups resolves the groups of a user through the gateway
+func (fs *root) userGroups(id *userpb.UserId) ([]string, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	groupsResp, err := client.GetUserGroups(fs.authCtx, &userpb.GetUserGroupsRequest{UserId: id})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs3Error("get user groups", groupsResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	return groupsResp.GetGroups(), nil
+}
+
+// chrootMounts returns the directory the session is confined to, mounted as the root. Nothing is mounted
+// if the configured space is not available to the user, so that every path is reported as missing.
+func (fs *root) chrootMounts(spaces []*provider.StorageSpace) []mount {
+	for _, spc := range spaces {
+		var match bool
+		if fs.chroot.Space != "" {
+			match = spc.GetId().GetOpaqueId() == fs.chroot.Space || spc.GetRoot().GetSpaceId() == fs.chroot.Space
+		} else {
+			match = spc.GetSpaceType() == "personal" && spc.GetOwner().GetId().GetOpaqueId() == fs.userID
+		}
+
+		if match {
+			return []mount{{path: "/", space: spc, rank: rankPersonal, base: fs.chroot.Path}}
+		}
+	}
+
+	return nil
+}
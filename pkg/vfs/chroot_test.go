@@ -0,0 +1,187 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/rs/zerolog"
+)
+
+func testSpaces() []*provider.StorageSpace {
+	return []*provider.StorageSpace{
+		{
+			Id:        &provider.StorageSpaceId{OpaqueId: "storage$other"},
+			Root:      &provider.ResourceId{StorageId: "storage", SpaceId: "other"},
+			SpaceType: "personal",
+			Owner:     &userpb.User{Id: &userpb.UserId{OpaqueId: "bob"}},
+		},
+		{
+			Id:        &provider.StorageSpaceId{OpaqueId: "storage$alice"},
+			Root:      &provider.ResourceId{StorageId: "storage", SpaceId: "alice"},
+			SpaceType: "personal",
+			Owner:     &userpb.User{Id: &userpb.UserId{OpaqueId: "alice"}},
+		},
+		{
+			Id:        &provider.StorageSpaceId{OpaqueId: "storage$project"},
+			Root:      &provider.ResourceId{StorageId: "storage", SpaceId: "project"},
+			SpaceType: "project",
+		},
+	}
+}
+
+func testChrootRoot(cfg config.Chroot) *root {
+	return &root{
+		userID:   "alice",
+		username: "alice",
+		home:     "/",
+		log:      zerolog.Nop(),
+		chroot:   &cfg,
+	}
+}
+
+func TestChrootFor(t *testing.T) {
+	cfg := config.Chroot{Users: []string{"alice"}, Groups: []string{"guests"}, Path: "/upload"}
+
+	tests := []struct {
+		name     string
+		username string
+		groups   []string
+		want     bool
+	}{
+		{"user", "alice", nil, true},
+		{"group", "bob", []string{"staff", "guests"}, true},
+		{"no match", "bob", []string{"staff"}, false},
+		{"no groups", "bob", nil, false},
+		{"group named like a user", "carol", []string{"alice"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chrootFor(cfg, tt.username, tt.groups)
+			if (got != nil) != tt.want {
+				t.Fatalf("Expected chroot %v, got %v", tt.want, got)
+			}
+			if got != nil && got.Path != cfg.Path {
+				t.Fatalf("Expected path %s, got %s", cfg.Path, got.Path)
+			}
+		})
+	}
+}
+
+func TestChrootMounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		space string
+		want  string
+	}{
+		{"personal space of the user", "", "storage$alice"},
+		{"space id", "storage$project", "storage$project"},
+		{"root space id", "project", "storage$project"},
+		{"unknown space", "storage$typo", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testChrootRoot(config.Chroot{Space: tt.space, Path: "/upload"})
+
+			mounts := fs.chrootMounts(testSpaces())
+			if tt.want == "" {
+				if len(mounts) != 0 {
+					t.Fatalf("Expected no mounts, got %v", mounts)
+				}
+				return
+			}
+
+			if len(mounts) != 1 {
+				t.Fatalf("Expected a single mount, got %v", mounts)
+			}
+			m := mounts[0]
+			if m.path != "/" || m.base != "/upload" || m.space.GetId().GetOpaqueId() != tt.want {
+				t.Fatalf("Expected %s mounted at / with base /upload, got %s at %s with base %s",
+					tt.want, m.space.GetId().GetOpaqueId(), m.path, m.base)
+			}
+		})
+	}
+}
+
+// Every path a client sends, whether in a request handled by pkg/sftp or in the arguments of an extension
+// like copy-file, is resolved by findMount. In a chroot there is a single mount, so rename targets which
+// name another space end up in the chroot directory as well.
+func TestFindMount_Chroot(t *testing.T) {
+	fs := testChrootRoot(config.Chroot{Path: "/upload"})
+	mounts := fs.chrootMounts(testSpaces())
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"root", "/", "/upload"},
+		{"file", "/dir/file.txt", "/upload/dir/file.txt"},
+		{"parent of the root", "/..", "/upload"},
+		{"above the root", "/../../etc/passwd", "/upload/etc/passwd"},
+		{"back out of a directory", "/dir/../../../file.txt", "/upload/file.txt"},
+		{"relative", "../file.txt", "/upload/file.txt"},
+		{"dot segments", "/./dir/./", "/upload/dir"},
+		{"double slashes", "//dir//file.txt", "/upload/dir/file.txt"},
+		{"other space", "/Project/file.txt", "/upload/Project/file.txt"},
+		{"other space above the root", "/../Project/file.txt", "/upload/Project/file.txt"},
+		{"base of the chroot", "/../upload/../file.txt", "/upload/file.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rel := findMount(mounts, tt.path)
+			if m == nil {
+				t.Fatalf("Expected %s to be within the chroot", tt.path)
+			}
+			if m.space.GetId().GetOpaqueId() != "storage$alice" {
+				t.Fatalf("Expected %s to be in the chroot space, got %s", tt.path, m.space.GetId().GetOpaqueId())
+			}
+			if rel != tt.want {
+				t.Fatalf("Expected %s to resolve to %s, got %s", tt.path, tt.want, rel)
+			}
+		})
+	}
+}
+
+func TestRealPath_Chroot(t *testing.T) {
+	fs := testChrootRoot(config.Chroot{Path: "/upload"})
+	mounts := fs.chrootMounts(testSpaces())
+
+	tests := []struct {
+		name    string
+		resolve func() (string, error)
+		want    string
+	}{
+		{"realpath absolute", func() (string, error) { return fs.RealPath("/../../etc") }, "/upload/etc"},
+		{"realpath relative", func() (string, error) { return fs.RealPath("../../etc") }, "/upload/etc"},
+		{"expand-path home", func() (string, error) { return fs.expandPath("~/../..") }, "/upload"},
+		{"expand-path user", func() (string, error) { return fs.expandPath("~alice/../../etc") }, "/upload/etc"},
+		{"expand-path relative", func() (string, error) { return fs.expandPath("../etc") }, "/upload/etc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.resolve()
+			if err != nil {
+				t.Fatalf("Failed to resolve path: %v", err)
+			}
+
+			m, rel := findMount(mounts, p)
+			if m == nil {
+				t.Fatalf("Expected %s to be within the chroot", p)
+			}
+			if rel != tt.want {
+				t.Fatalf("Expected %s to resolve to %s, got %s", p, tt.want, rel)
+			}
+		})
+	}
+
+	// the home directories of other users are not known
+	if _, err := fs.expandPath("~bob/../alice"); err == nil {
+		t.Fatalf("Expected the home directory of another user to be unknown")
+	}
+}
@@ -0,0 +1,232 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"syscall"
+
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// handleCopyData handles copy-data requests, which copy a range of a file opened for reading into a file opened
+// for writing, as used by "cp" in the OpenSSH sftp client. A length of zero copies up to the end of the file.
+// The content is streamed from the data gateway into the buffer of the writing handle, without passing the client.
+func (fs *root) handleCopyData(req *sftpext.Request) ([]byte, error) {
+	readPath, readFile, err := req.File()
+	if err != nil {
+		return nil, err
+	}
+	readOffset, err := req.Uint64()
+	if err != nil {
+		return nil, err
+	}
+	length, err := req.Uint64()
+	if err != nil {
+		return nil, err
+	}
+	writePath, writeFile, err := req.File()
+	if err != nil {
+		return nil, err
+	}
+	writeOffset, err := req.Uint64()
+	if err != nil {
+		return nil, err
+	}
+
+	// both ranges have to end within the offsets a file can have
+	if readOffset > math.MaxInt64 || writeOffset > math.MaxInt64 || length > math.MaxInt64-max(readOffset, writeOffset) {
+		return nil, os.ErrInvalid
+	}
+
+	fs.log.Debug().
+		Str("source", readPath).
+		Uint64("offset", readOffset).
+		Uint64("length", length).
+		Str("target", writePath).
+		Uint64("target-offset", writeOffset).
+		Msg("copy-data called")
+
+	// the handles are resolved to the files opened for them, as a path may be open more than once
+	w, ok := writeFile.(*sftpFileHandler)
+	if !ok || !w.writable() {
+		return nil, sftpext.ErrBadHandle
+	}
+
+	// the copy bypasses the request server, so the handle is held open until it is done
+	releaseWriter, err := w.hold()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseWriter()
+
+	if readFile == writeFile && overlaps(readOffset, length, writeOffset) {
+		return nil, errors.New("source and target ranges overlap")
+	}
+
+	r, _, release, err := fs.handleReader(readPath, readFile)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if length == 0 {
+		length = uint64(math.MaxInt64) - readOffset
+	}
+
+	_, err = io.Copy(io.NewOffsetWriter(w, int64(writeOffset)), io.NewSectionReader(r, int64(readOffset), int64(length)))
+	return nil, err
+}
+
+// handleCopyFile handles copy-file requests, which copy a file to a new path within the server.
+// The target is only replaced if the client asks for it.
+func (fs *root) handleCopyFile(req *sftpext.Request) ([]byte, error) {
+	source, err := req.Path()
+	if err != nil {
+		return nil, err
+	}
+	target, err := req.Path()
+	if err != nil {
+		return nil, err
+	}
+	overwrite, err := req.Bool()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.log.Debug().
+		Str("source", source).
+		Str("target", target).
+		Bool("overwrite", overwrite).
+		Msg("copy-file called")
+
+	srcRef, err := fs.resolve(source)
+	var versionsErr *versionsPathError
+	if errors.As(err, &versionsErr) {
+		return nil, fs.copyVersion(versionsErr, target, overwrite)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dstRef, err := fs.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+
+	srcInfo, err := fs.statRef(srcRef)
+	if err != nil {
+		return nil, err
+	}
+	if srcInfo == nil {
+		return nil, os.ErrNotExist
+	}
+	if srcInfo.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return nil, syscall.EISDIR
+	}
+
+	return nil, fs.transfer(srcRef, srcInfo, dstRef, overwrite)
+}
+
+// copyVersion copies the version of loc to the absolute path target. Copying a version onto its own file
+// restores it, which keeps the current content as a version, so the target is replaced without being asked to.
+func (fs *root) copyVersion(loc *versionsPathError, target string, overwrite bool) error {
+	spc, rel, err := fs.findSpace(target)
+	if err != nil {
+		return err
+	}
+	if spc == nil {
+		return os.ErrNotExist
+	}
+
+	if restoresVersion(loc, spc, rel) {
+		return fs.restoreFileVersion(loc)
+	}
+
+	dstRef, err := fs.resolve(target)
+	if err != nil {
+		return err
+	}
+
+	_, srcRef, srcInfo, err := fs.fileVersion(loc)
+	if err != nil {
+		return err
+	}
+
+	return fs.transfer(srcRef, srcInfo, dstRef, overwrite)
+}
+
+// contentReader returns a reader for the content of the file at p. Content written through a handle of the
+// same session is read from its buffer, in which case no resource info is returned, as the stored one is stale.
+// release must be called once the reader is no longer needed.
+func (fs *root) contentReader(p string) (r io.ReaderAt, info *provider.ResourceInfo, release func(), err error) {
+	if h := fs.writer(p); h != nil {
+		// a handle closed in the meantime has its content stored
+		if release, err := h.hold(); err == nil {
+			return h, nil, release, nil
+		}
+	}
+
+	return fs.storedReader(p)
+}
+
+// handleReader is like contentReader for the file at p opened by a handle, file is what has been opened for it.
+// Files open for writing are read from their own buffer, other handles read the stored content.
+func (fs *root) handleReader(p string, file any) (r io.ReaderAt, info *provider.ResourceInfo, release func(), err error) {
+	if h, ok := file.(*sftpFileHandler); ok && h.writable() {
+		release, err := h.hold()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return h, nil, release, nil
+	}
+
+	return fs.storedReader(p)
+}
+
+// storedReader returns a reader for the stored content of the file at p, along with its resource info
+func (fs *root) storedReader(p string) (r io.ReaderAt, info *provider.ResourceInfo, release func(), err error) {
+	ref, err := fs.resolve(p)
+	var versionsErr *versionsPathError
+	switch {
+	case errors.As(err, &versionsErr):
+		// versions are read like files, by the reference returned with them
+		if _, ref, info, err = fs.fileVersion(versionsErr); err != nil {
+			return nil, nil, nil, err
+		}
+	case err != nil:
+		return nil, nil, nil, err
+	default:
+		info, err = fs.statRef(ref)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if info == nil {
+			return nil, nil, nil, os.ErrNotExist
+		}
+		if info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			return nil, nil, nil, syscall.EISDIR
+		}
+	}
+
+	reader := newRangeReader(fs, ref, int64(info.GetSize()))
+	return reader, info, func() { reader.Close() }, nil
+}
+
+// overlaps reports whether the range of length bytes at readOffset overlaps with the range written at
+// writeOffset. A length of zero extends to the end of the file.
+func overlaps(readOffset, length, writeOffset uint64) bool {
+	if length == 0 {
+		return true
+	}
+
+	// ranges of the same length overlap if their starts are less than length apart, which is
+	// computed without adding to the offsets, so that it does not overflow
+	if readOffset > writeOffset {
+		return readOffset-writeOffset < length
+	}
+
+	return writeOffset-readOffset < length
+}
@@ -0,0 +1,275 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// moveAcrossSpaces moves a file or a directory tree into another space. Storage providers cannot move
+// resources between spaces, so the content is copied and the source is deleted last: if the copy fails,
+// the target is left untouched, if only the deletion fails, both copies exist and the error says so.
+func (fs *root) moveAcrossSpaces(source, target *provider.Reference, allowOverwrite bool) error {
+	if source.GetPath() == "." {
+		// spaces themselves cannot be moved
+		return os.ErrPermission
+	}
+
+	srcInfo, err := fs.statRef(source)
+	if err != nil {
+		return err
+	}
+	if srcInfo == nil {
+		return os.ErrNotExist
+	}
+
+	if err := fs.transfer(source, srcInfo, target, allowOverwrite); err != nil {
+		return err
+	}
+
+	if err := fs.deleteRef(source); err != nil {
+		fs.log.Error().
+			Err(err).
+			Str("source", source.GetPath()).
+			Str("target", target.GetPath()).
+			Msg("Moved across spaces, but could not delete the source")
+		return fmt.Errorf("copied to target, but could not delete source: %w", err)
+	}
+
+	return nil
+}
+
+// transfer copies the resource described by srcInfo to target within the server. The content is streamed
+// into a hidden temporary resource next to the target, which is moved onto the target once it is complete,
+// so the target never holds a partial copy. An existing file is replaced by an upload instead, which keeps
+// its id and history, the storage only replaces the content once the upload is complete.
+func (fs *root) transfer(source *provider.Reference, srcInfo *provider.ResourceInfo, target *provider.Reference, allowOverwrite bool) error {
+	dstInfo, err := fs.statRef(target)
+	if err != nil {
+		return err
+	}
+
+	if dstInfo != nil {
+		if err := fs.checkReplace(srcInfo, dstInfo, target, allowOverwrite); err != nil {
+			return err
+		}
+
+		if dstInfo.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			// the storage does not move onto an existing file
+			if err := fs.copyFile(source, target, int64(srcInfo.GetSize()), dstInfo.GetEtag()); err != nil {
+				return err
+			}
+			return fs.keepMtime(target, srcInfo)
+		}
+	}
+
+	tmp := stagingRef(target)
+
+	var id string
+	if fs.staging != nil {
+		// recorded, so that the copy is removed by the janitor if the service crashes
+		if id, err = fs.staging.add(fs.userID, tmp); err != nil {
+			return err
+		}
+	}
+
+	moved := false
+	defer func() {
+		// an entry is only dropped once the temporary resource is gone, otherwise the janitor removes it later
+		cleaned := moved || fs.deleteStaged(tmp)
+		switch {
+		case id == "":
+		case cleaned:
+			fs.staging.remove(id)
+		default:
+			fs.staging.abandon(id)
+		}
+	}()
+
+	if err := fs.copyTree(source, srcInfo, tmp); err != nil {
+		return err
+	}
+
+	if dstInfo != nil && dstInfo.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		// an empty directory is replaced, which the storage does not do on move
+		if err := fs.deleteRef(target); err != nil {
+			return err
+		}
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	moveResp, err := client.Move(fs.authCtx, &provider.MoveRequest{Source: tmp, Destination: target})
+	if err != nil {
+		return err
+	}
+	if err := cs3Error("move", moveResp.GetStatus()); err != nil {
+		return err
+	}
+	moved = true
+
+	return nil
+}
+
+// checkReplace applies the rename semantics to an existing target. SFTP rename fails, POSIX rename replaces
+// a file with a file, or a directory with an empty directory.
+func (fs *root) checkReplace(srcInfo, dstInfo *provider.ResourceInfo, target *provider.Reference, allowOverwrite bool) error {
+	if !allowOverwrite {
+		return os.ErrExist
+	}
+
+	srcDir := srcInfo.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+	dstDir := dstInfo.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+
+	switch {
+	case srcDir && !dstDir:
+		return syscall.ENOTDIR
+	case !srcDir && dstDir:
+		return syscall.EISDIR
+	case !dstDir:
+		return nil
+	}
+
+	children, err := fs.listRef(target)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return errNotEmpty
+	}
+
+	return nil
+}
+
+// copyTree copies the resource described by info to dst, descending into directories.
+// Modification times are kept.
+func (fs *root) copyTree(src *provider.Reference, info *provider.ResourceInfo, dst *provider.Reference) error {
+	if info.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		if err := fs.copyFile(src, dst, int64(info.GetSize()), ""); err != nil {
+			return fmt.Errorf("copying %s failed: %w", src.GetPath(), err)
+		}
+		return fs.keepMtime(dst, info)
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	mkResp, err := client.CreateContainer(fs.authCtx, &provider.CreateContainerRequest{Ref: dst})
+	if err != nil {
+		return err
+	}
+	if err := cs3Error("create directory", mkResp.GetStatus()); err != nil {
+		return fmt.Errorf("creating %s failed: %w", dst.GetPath(), err)
+	}
+
+	children, err := fs.listRef(src)
+	if err != nil {
+		return fmt.Errorf("listing %s failed: %w", src.GetPath(), err)
+	}
+
+	for _, child := range children {
+		if isStagingName(child.GetName()) {
+			continue
+		}
+
+		childSrc := &provider.Reference{ResourceId: src.GetResourceId(), Path: path.Join(src.GetPath(), child.GetName())}
+		childDst := &provider.Reference{ResourceId: dst.GetResourceId(), Path: path.Join(dst.GetPath(), child.GetName())}
+
+		if err := fs.copyTree(childSrc, child, childDst); err != nil {
+			return err
+		}
+	}
+
+	return fs.keepMtime(dst, info)
+}
+
+// copyFile streams the content of src into an upload to dst. A non-empty etag makes the upload fail
+// if dst has been changed meanwhile.
+func (fs *root) copyFile(src, dst *provider.Reference, size int64, etag string) error {
+	reader := newRangeReader(fs, src, size)
+	defer reader.Close()
+
+	_, err := fs.upload(dst, reader, size, etag)
+	return err
+}
+
+// keepMtime sets the modification time of info on dst
+func (fs *root) keepMtime(dst *provider.Reference, info *provider.ResourceInfo) error {
+	if info.GetMtime() == nil {
+		return nil
+	}
+
+	return fs.setMtime(dst, time.Unix(int64(info.GetMtime().GetSeconds()), int64(info.GetMtime().GetNanos())))
+}
+
+// statRef returns the resource info of ref, or nil if it does not exist
+func (fs *root) statRef(ref *provider.Reference) (*provider.ResourceInfo, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	statResp, err := client.Stat(fs.authCtx, &provider.StatRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if statResp.GetStatus().GetCode() == rpc.Code_CODE_NOT_FOUND {
+		return nil, nil
+	}
+	if err := cs3Error("stat", statResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	return statResp.GetInfo(), nil
+}
+
+// listRef returns the resource infos of the children of a directory
+func (fs *root) listRef(ref *provider.Reference) ([]*provider.ResourceInfo, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	listResp, err := client.ListContainer(fs.authCtx, &provider.ListContainerRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs3Error("list directory", listResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	return listResp.GetInfos(), nil
+}
+
+// deleteRef deletes a file or a directory tree
+func (fs *root) deleteRef(ref *provider.Reference) error {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	deleteResp, err := client.Delete(fs.authCtx, &provider.DeleteRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return err
+	}
+
+	return cs3Error("delete", deleteResp.GetStatus())
+}
@@ -2,30 +2,32 @@ package vfs
 
 import (
 	"errors"
-	"fmt"
 	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
 	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
 	storageProvider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 
 	"os"
+	"path"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func (fs *root) mkdir(dirPath string) error {
-	storageSpaces, err := fs.listStorageSpaces()
-	if err != nil {
-		return err
+	spc, relPath, err := fs.findSpace(dirPath)
+	var versionsErr *versionsPathError
+	if errors.As(err, &versionsErr) && versionsErr.file == "" {
+		// a real .versions directory can be created, it takes the place of the versions view
+		err = nil
 	}
-
-	spc, relPath, err := spacelookup.FindSpaceForPath(dirPath, storageSpaces)
 	if err != nil {
 		return err
 	}
 
 	if spc == nil {
-		return os.ErrNotExist
+		// directories where project spaces are mounted create a project space
+		return fs.createProjectSpace(dirPath)
 	}
 
 	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
@@ -47,20 +49,12 @@ func (fs *root) mkdir(dirPath string) error {
 		return err
 	}
 
-	respCode := mkCntRes.GetStatus().GetCode()
-
-	if respCode != rpc.Code_CODE_OK {
-		if respCode == rpc.Code_CODE_ALREADY_EXISTS {
-			return fmt.Errorf("failed to create container: %w", os.ErrExist)
-		}
-
-		err = fmt.Errorf("failed to create container: %s", mkCntRes.GetStatus().GetMessage())
+	if err := cs3Error("create directory", mkCntRes.GetStatus()); err != nil {
 		fs.log.Debug().
 			Err(err).
 			Str("path", relPath).
-			Str("code", respCode.String()).
-			Msgf("Could not create container: %s", err)
-
+			Str("code", mkCntRes.GetStatus().GetCode().String()).
+			Msg("Could not create container")
 		return err
 	}
 
@@ -73,29 +67,57 @@ func (fs *root) renameFile(oldpath, newpath string, allowOverwrite bool) error {
 	if err != nil {
 		return err
 	}
+	mounts := fs.mounts(storageSpaces)
 
 	// Find space and relative path for source
-	sourceSpc, sourceRelPath, err := spacelookup.FindSpaceForPath(oldpath, storageSpaces)
-	if err != nil {
-		return err
-	}
-	if sourceSpc == nil {
+	sourceMount, sourceRelPath := findMount(mounts, oldpath)
+	if sourceMount == nil {
 		return os.ErrNotExist
 	}
+	sourceSpc := sourceMount.space
 
-	// Find space and relative path for target
-	targetSpc, targetRelPath, err := spacelookup.FindSpaceForPath(newpath, storageSpaces)
-	if err != nil {
-		return err
+	// renaming the directory of a project space renames the space
+	if oldpath == sourceMount.path {
+		return fs.renameProjectSpace(sourceMount, mounts, newpath)
 	}
-	if targetSpc == nil {
+
+	// Find space and relative path for target
+	targetMount, targetRelPath := findMount(mounts, newpath)
+	if targetMount == nil {
 		return os.ErrNotExist
 	}
+	targetSpc := targetMount.space
 
-	// Check if source and target are in the same storage space
-	if sourceSpc.Id.GetOpaqueId() != targetSpc.Id.GetOpaqueId() {
-		// Cross-space moves are not supported in this implementation
-		return fmt.Errorf("cross-space moves are not supported")
+	// trash items are restored by moving them out of the trash, nothing can be moved into it
+	if _, ok := trashPath(targetMount, targetRelPath); ok {
+		return os.ErrPermission
+	}
+	sourceTrashPath, fromTrash := trashPath(sourceMount, sourceRelPath)
+	if fromTrash && sourceSpc.Id.GetOpaqueId() != targetSpc.Id.GetOpaqueId() {
+		return os.ErrPermission
+	}
+
+	// pending shares are accepted by moving them into the shares, where they are mounted under the new name
+	if _, ok := pendingPath(targetSpc, targetRelPath); ok {
+		return os.ErrPermission
+	}
+	if name, ok := pendingPath(sourceSpc, sourceRelPath); ok {
+		mountPoint, ok := shareRoot(targetSpc, targetRelPath)
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return os.ErrPermission
+		}
+		return fs.acceptShare(name, mountPoint)
+	}
+
+	// versions are restored by moving them onto their file, which always exists
+	if _, ok := fs.versionsPath(targetMount, targetRelPath); ok {
+		return os.ErrPermission
+	}
+	if loc, ok := fs.versionsPath(sourceMount, sourceRelPath); ok && !fromTrash {
+		if !restoresVersion(loc, targetSpc, targetRelPath) {
+			return os.ErrPermission
+		}
+		return fs.restoreFileVersion(loc)
 	}
 
 	// Create source reference
@@ -130,6 +152,15 @@ func (fs *root) renameFile(oldpath, newpath string, allowOverwrite bool) error {
 		// If stat returned not found, that's what we want - continue with rename
 	}
 
+	if fromTrash {
+		return fs.restoreTrashItem(sourceSpc, sourceTrashPath, &targetRef)
+	}
+
+	// Storage providers only move within a space, moves between spaces are carried out as copy and delete
+	if sourceSpc.Id.GetOpaqueId() != targetSpc.Id.GetOpaqueId() {
+		return fs.moveAcrossSpaces(&sourceRef, &targetRef, allowOverwrite)
+	}
+
 	// Perform the move/rename operation
 	moveResp, err := client.Move(fs.authCtx, &storageProvider.MoveRequest{
 		Source:      &sourceRef,
@@ -139,36 +170,31 @@ func (fs *root) renameFile(oldpath, newpath string, allowOverwrite bool) error {
 		return err
 	}
 
-	if moveResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		switch moveResp.GetStatus().GetCode() {
-		case rpc.Code_CODE_NOT_FOUND:
-			return os.ErrNotExist
-		case rpc.Code_CODE_ALREADY_EXISTS:
-			return os.ErrExist
-		case rpc.Code_CODE_PERMISSION_DENIED:
-			return os.ErrPermission
-		default:
-			err := fmt.Errorf("move failed: %s", moveResp.GetStatus().GetMessage())
-			fs.log.Debug().
-				Err(err).
-				Str("sourcePath", oldpath).
-				Str("targetPath", newpath).
-				Str("code", moveResp.GetStatus().GetCode().String()).
-				Msg("Could not move/rename file")
-			return err
-		}
+	if err := cs3Error("move", moveResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("sourcePath", oldpath).
+			Str("targetPath", newpath).
+			Str("code", moveResp.GetStatus().GetCode().String()).
+			Msg("Could not move/rename file")
+		return err
 	}
 
 	return nil
 }
 
 func (fs *root) remove(pathname string) error {
-	storageSpaces, err := fs.listStorageSpaces()
-	if err != nil {
-		return err
+	spc, relPath, err := fs.findSpace(pathname)
+	var trashErr *trashPathError
+	if errors.As(err, &trashErr) {
+		// removing a trash item purges it
+		return fs.purgeTrashItem(trashErr.space, trashErr.path, false)
+	}
+	var pendingErr *pendingPathError
+	if errors.As(err, &pendingErr) {
+		// removing a pending share declines it
+		return fs.declineShare(pendingErr.name)
 	}
-
-	spc, relPath, err := spacelookup.FindSpaceForPath(pathname, storageSpaces)
 	if err != nil {
 		return err
 	}
@@ -196,11 +222,8 @@ func (fs *root) remove(pathname string) error {
 		return err
 	}
 
-	if statResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		if statResp.GetStatus().GetCode() == rpc.Code_CODE_NOT_FOUND {
-			return os.ErrNotExist
-		}
-		return fmt.Errorf("stat failed: %s", statResp.GetStatus().GetMessage())
+	if err := cs3Error("stat", statResp.GetStatus()); err != nil {
+		return err
 	}
 
 	// Check if it's a directory
@@ -210,6 +233,16 @@ func (fs *root) remove(pathname string) error {
 		return os.ErrInvalid
 	}
 
+	// Shares are removed by declining them, deleting them would delete the shared resource of the owner.
+	// This needs no permission on the resource, read-only shares can be declined as well.
+	if mountPoint, ok := shareRoot(spc, relPath); ok {
+		return fs.unmountShare(mountPoint)
+	}
+
+	if !mayDelete(statResp.GetInfo()) {
+		return newStatusError("delete", syscall.EACCES)
+	}
+
 	// Delete the file
 	deleteResp, err := client.Delete(fs.authCtx, &storageProvider.DeleteRequest{
 		Ref: &ref,
@@ -218,11 +251,7 @@ func (fs *root) remove(pathname string) error {
 		return err
 	}
 
-	if deleteResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		if deleteResp.GetStatus().GetCode() == rpc.Code_CODE_NOT_FOUND {
-			return os.ErrNotExist
-		}
-		err = fmt.Errorf("delete failed: %s", deleteResp.GetStatus().GetMessage())
+	if err := cs3Error("delete", deleteResp.GetStatus()); err != nil {
 		fs.log.Debug().
 			Err(err).
 			Str("path", pathname).
@@ -235,12 +264,16 @@ func (fs *root) remove(pathname string) error {
 }
 
 func (fs *root) rmdir(pathname string) error {
-	storageSpaces, err := fs.listStorageSpaces()
-	if err != nil {
-		return err
+	spc, relPath, err := fs.findSpace(pathname)
+	var trashErr *trashPathError
+	if errors.As(err, &trashErr) {
+		// removing a trash item purges it
+		return fs.purgeTrashItem(trashErr.space, trashErr.path, true)
+	}
+	var pendingErr *pendingPathError
+	if errors.As(err, &pendingErr) {
+		return fs.declineShare(pendingErr.name)
 	}
-
-	spc, relPath, err := spacelookup.FindSpaceForPath(pathname, storageSpaces)
 	if err != nil {
 		return err
 	}
@@ -249,6 +282,11 @@ func (fs *root) rmdir(pathname string) error {
 		return os.ErrNotExist
 	}
 
+	// removing the directory of a project space disables the space
+	if relPath == "/" {
+		return fs.disableProjectSpace(spc)
+	}
+
 	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
 	if err != nil {
 		fs.log.Debug().Err(err).Msg("makeStorageSpaceReference error in rmdir")
@@ -268,11 +306,8 @@ func (fs *root) rmdir(pathname string) error {
 		return err
 	}
 
-	if statResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		if statResp.GetStatus().GetCode() == rpc.Code_CODE_NOT_FOUND {
-			return os.ErrNotExist
-		}
-		return fmt.Errorf("stat failed: %s", statResp.GetStatus().GetMessage())
+	if err := cs3Error("stat", statResp.GetStatus()); err != nil {
+		return err
 	}
 
 	// IEEE 1003.1: If pathname is a symlink, then rmdir should fail with ENOTDIR.
@@ -280,6 +315,15 @@ func (fs *root) rmdir(pathname string) error {
 		return syscall.ENOTDIR
 	}
 
+	// Shares are removed by declining them, whatever they contain, as their content is not deleted
+	if mountPoint, ok := shareRoot(spc, relPath); ok {
+		return fs.unmountShare(mountPoint)
+	}
+
+	if !mayDelete(statResp.GetInfo()) {
+		return newStatusError("remove directory", syscall.EACCES)
+	}
+
 	// Check if directory is empty
 	listResp, err := client.ListContainer(fs.authCtx, &storageProvider.ListContainerRequest{
 		Ref: &ref,
@@ -288,12 +332,12 @@ func (fs *root) rmdir(pathname string) error {
 		return err
 	}
 
-	if listResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		return fmt.Errorf("list container failed: %s", listResp.GetStatus().GetMessage())
+	if err := cs3Error("list directory", listResp.GetStatus()); err != nil {
+		return err
 	}
 
 	if len(listResp.GetInfos()) > 0 {
-		return errors.New("directory not empty")
+		return errNotEmpty
 	}
 
 	// Delete the empty directory
@@ -304,11 +348,7 @@ func (fs *root) rmdir(pathname string) error {
 		return err
 	}
 
-	if deleteResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
-		if deleteResp.GetStatus().GetCode() == rpc.Code_CODE_NOT_FOUND {
-			return os.ErrNotExist
-		}
-		err = fmt.Errorf("delete directory failed: %s", deleteResp.GetStatus().GetMessage())
+	if err := cs3Error("remove directory", deleteResp.GetStatus()); err != nil {
 		fs.log.Debug().
 			Err(err).
 			Str("path", pathname).
@@ -327,18 +367,25 @@ func (fs *root) list(dirPath string) ([]os.FileInfo, error) {
 		return nil, err
 	}
 
-	if dirPath == "/" {
-		finfos := storageSpacesToFileInfo(storageSpaces)
-		return finfos, nil
+	mounts := fs.mounts(storageSpaces)
+	m, relPath := findMount(mounts, dirPath)
+	if m == nil {
+		// directories of the layout list the spaces mounted in them
+		if entries, ok := virtualDir(mounts, dirPath); ok {
+			return entries, nil
+		}
+		return nil, os.ErrNotExist
 	}
+	spc := m.space
 
-	spc, relPath, err := spacelookup.FindSpaceForPath(dirPath, storageSpaces)
-	if err != nil {
-		return nil, err
+	if rest, ok := trashPath(m, relPath); ok {
+		return fs.listTrash(spc, rest)
 	}
-
-	if spc == nil {
-		return nil, os.ErrNotExist
+	if name, ok := pendingPath(spc, relPath); ok {
+		return fs.listPending(name)
+	}
+	if loc, ok := fs.versionsPath(m, relPath); ok {
+		return fs.listVersions(loc)
 	}
 
 	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
@@ -366,34 +413,55 @@ func (fs *root) list(dirPath string) ([]os.FileInfo, error) {
 		return nil, err
 	}
 
-	if listResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
+	if err := cs3Error("list directory", listResp.GetStatus()); err != nil {
 		fs.log.Debug().
 			Str("code", listResp.GetStatus().GetCode().String()).
 			Str("message", listResp.GetStatus().GetMessage()).
 			Msg("ListContainer status not OK")
-		return nil, fmt.Errorf("list container failed: %s", listResp.GetStatus().GetMessage())
+		return nil, err
 	}
 
 	infos := listResp.GetInfos()
 	fs.log.Debug().Int("itemCount", len(infos)).Msg("ListContainer returned items")
-	fileInfos := toFileInfos(infos...)
+	fileInfos := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		// temporary resources of atomic uploads in progress are not shown
+		if isStagingName(info.GetName()) {
+			continue
+		}
+
+		fileInfos = append(fileInfos, toFileInfos(info)[0])
+	}
 	return fileInfos, nil
 
 }
 
-func (fs *root) stat(path string) (os.FileInfo, error) {
+// stat returns the file info of the resource at p. If resumed is set, files with a kept interrupted upload
+// report the size received so far instead of the stored size.
+func (fs *root) stat(p string, resumed bool) (os.FileInfo, error) {
 	storageSpaces, err := fs.listStorageSpaces()
 	if err != nil {
 		return nil, err
 	}
 
-	spc, relPath, err := spacelookup.FindSpaceForPath(path, storageSpaces)
-	if err != nil {
-		return nil, err
+	mounts := fs.mounts(storageSpaces)
+	m, relPath := findMount(mounts, p)
+	if m == nil {
+		if _, ok := virtualDir(mounts, p); ok {
+			return fileInfo{name: path.Base(p), mode: os.FileMode(0775) | os.ModeDir, isDir: true}, nil
+		}
+		return nil, os.ErrNotExist
 	}
+	spc := m.space
 
-	if spc == nil {
-		return nil, os.ErrNotExist
+	if rest, ok := trashPath(m, relPath); ok {
+		return fs.statTrash(spc, rest)
+	}
+	if name, ok := pendingPath(spc, relPath); ok {
+		return fs.statPending(name)
+	}
+	if loc, ok := fs.versionsPath(m, relPath); ok {
+		return fs.statVersions(loc)
 	}
 
 	client, err := fs.gwSelector.Next()
@@ -413,9 +481,39 @@ func (fs *root) stat(path string) (os.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := cs3Error("stat", statResp.GetStatus()); err != nil {
+		return nil, err
+	}
 
-	fi := toFileInfos(statResp.GetInfo())
-	return fi[0], nil
+	fi := toFileInfos(statResp.GetInfo())[0].(fileInfo)
+	if resumed {
+		fi.size = fs.resumedSize(&ref, statResp.GetInfo())
+	}
+	if p == m.path {
+		// space roots are named after their mount point
+		fi.name = path.Base(m.path)
+	}
+	return fi, nil
+}
+
+// resolve returns a reference to the resource at the absolute path
+func (fs *root) resolve(p string) (*storageProvider.Reference, error) {
+	spc, relPath, err := fs.findSpace(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if spc == nil {
+		return nil, os.ErrNotExist
+	}
+
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
+	if err != nil {
+		fs.log.Debug().Err(err).Msg("makeStorageSpaceReference error in resolve")
+		return nil, err
+	}
+
+	return &ref, nil
 }
 
 func (fs *root) listStorageSpaces() ([]*storageProvider.StorageSpace, error) {
@@ -432,7 +530,7 @@ func (fs *root) listStorageSpaces() ([]*storageProvider.StorageSpace, error) {
 	if err != nil {
 		return []*storageProvider.StorageSpace{}, err
 	}
-	if lSSRes.Status.GetCode() != rpc.Code_CODE_OK {
+	if err := cs3Error("list spaces", lSSRes.GetStatus()); err != nil {
 		return []*storageProvider.StorageSpace{}, err
 	}
 
@@ -443,18 +541,13 @@ func toFileInfos(rInfos ...*storageProvider.ResourceInfo) []os.FileInfo {
 	var fileInfos []os.FileInfo
 	for _, ri := range rInfos {
 		fi := fileInfo{
-			name: ri.GetName(),
-			size: int64(ri.GetSize()),
-			sys:  ri,
+			name:  ri.GetName(),
+			size:  int64(ri.GetSize()),
+			owner: ri.GetOwner(),
 		}
 
-		if ri.GetType() == storageProvider.ResourceType_RESOURCE_TYPE_CONTAINER {
-			fi.mode = os.FileMode(0755) | os.ModeDir
-			fi.isDir = true
-		} else {
-			fi.mode = os.FileMode(0644)
-			fi.isDir = false
-		}
+		fi.mode = fileMode(ri)
+		fi.isDir = ri.GetType() == storageProvider.ResourceType_RESOURCE_TYPE_CONTAINER
 
 		if ri.GetMtime() != nil {
 			fi.mtime = time.Unix(int64(ri.GetMtime().Seconds), 0)
@@ -464,26 +557,3 @@ func toFileInfos(rInfos ...*storageProvider.ResourceInfo) []os.FileInfo {
 	}
 	return fileInfos
 }
-
-func storageSpacesToFileInfo(spaces []*storageProvider.StorageSpace) []os.FileInfo {
-	var files = []os.FileInfo{}
-	for k := range spaces {
-		mode := os.FileMode(0775)
-		mode |= os.ModeDir
-		f := fileInfo{
-			name:  spaces[k].GetName(),
-			mode:  mode,
-			isDir: true,
-			sys:   spaces[k],
-		}
-
-		if spaces[k].GetMtime() != nil {
-			f.mtime = time.Unix(int64(spaces[k].GetMtime().Seconds), 0)
-		}
-
-		files = append(files, f)
-
-	}
-
-	return files
-}
@@ -0,0 +1,83 @@
+package vfs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// transferEndpoint is a data gateway endpoint handed out by InitiateFileDownload or InitiateFileUpload
+type transferEndpoint struct {
+	url   string
+	token string
+}
+
+// newDataGatewayClient creates the http client used for transfers against the data gateway.
+// There is no overall request timeout, since streamed bodies of large files may take arbitrarily long.
+func newDataGatewayClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true, // TODO: make configurable
+			},
+			ResponseHeaderTimeout: 30 * time.Second,
+			// keep the connections of concurrent range requests for reuse
+			MaxIdleConnsPerHost: 32,
+		},
+	}
+}
+
+// initiateDownload asks the gateway for a download endpoint of the referenced file
+func (fs *root) initiateDownload(ref *provider.Reference) (transferEndpoint, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return transferEndpoint{}, err
+	}
+
+	resp, err := client.InitiateFileDownload(fs.authCtx, &provider.InitiateFileDownloadRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return transferEndpoint{}, err
+	}
+	if err := cs3Error("initiate download", resp.GetStatus()); err != nil {
+		return transferEndpoint{}, err
+	}
+
+	return findDownloadEndpoint(resp)
+}
+
+// findDownloadEndpoint picks the simple/spaces protocol endpoint from a download response
+func findDownloadEndpoint(resp *gateway.InitiateFileDownloadResponse) (transferEndpoint, error) {
+	for _, proto := range resp.GetProtocols() {
+		if proto.GetProtocol() == "simple" || proto.GetProtocol() == "spaces" {
+			return transferEndpoint{url: proto.GetDownloadEndpoint(), token: proto.GetToken()}, nil
+		}
+	}
+
+	return transferEndpoint{}, fmt.Errorf("no suitable download protocol found")
+}
+
+// newTransferRequest creates a request against the data gateway carrying the access and transfer tokens
+func (fs *root) newTransferRequest(method string, ep transferEndpoint, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(fs.authCtx, method, ep.url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if token, err := extractAuthToken(fs.authCtx); err == nil {
+		httpReq.Header.Add("X-Access-Token", token)
+	}
+
+	if ep.token != "" {
+		httpReq.Header.Add("X-Reva-Transfer", ep.token)
+	}
+
+	return httpReq, nil
+}
@@ -0,0 +1,149 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"syscall"
+
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	"github.com/pkg/sftp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// errLocked is the cause of errors for resources locked by another client
+	errLocked = errors.New("resource is locked")
+	// errPrecondition is the cause of errors for changes the storage refuses in the state the resource is in,
+	// like uploads to a file which has been changed meanwhile
+	errPrecondition = errors.New("precondition failed")
+	// errUnavailable is the cause of errors for storage which can not be reached for now
+	errUnavailable = errors.New("storage is unavailable")
+	// errNotEmpty is returned when removing a directory which is not empty
+	errNotEmpty = &statusError{msg: "directory not empty", status: sftp.ErrSSHFxFailure, err: syscall.ENOTEMPTY}
+)
+
+// statusError is an error which is reported to the client with a specific SFTP status code and message.
+// pkg/sftp only recognizes a few errors by itself and reports everything else as a generic failure,
+// so errors reaching the client go through sftpError or are built by cs3Error and httpError.
+type statusError struct {
+	msg string
+	// status is one of the sftp.ErrSSHFx* errors, it selects the status code of the reply
+	status error
+	// err is what the error stands for within the package, like os.ErrNotExist, so that errors.Is keeps working
+	err error
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func (e *statusError) Unwrap() []error {
+	return []error{e.status, e.err}
+}
+
+// newStatusError returns the error for op failing because of cause, which selects the status code
+func newStatusError(op string, cause error) *statusError {
+	e := &statusError{msg: op + ": " + cause.Error(), status: sftp.ErrSSHFxFailure, err: cause}
+
+	switch {
+	case errors.Is(cause, os.ErrNotExist):
+		e.status = sftp.ErrSSHFxNoSuchFile
+	case errors.Is(cause, os.ErrPermission):
+		e.status = sftp.ErrSSHFxPermissionDenied
+	case errors.Is(cause, errors.ErrUnsupported):
+		e.status = sftp.ErrSSHFxOpUnsupported
+	}
+
+	return e
+}
+
+// cs3Error returns the error for the CS3 call op, which is nil if st is OK. Failures without a counterpart
+// on the client carry the message of the storage provider.
+func cs3Error(op string, st *rpc.Status) error {
+	var cause error
+	switch st.GetCode() {
+	case rpc.Code_CODE_OK:
+		return nil
+	case rpc.Code_CODE_NOT_FOUND:
+		cause = syscall.ENOENT
+	case rpc.Code_CODE_PERMISSION_DENIED, rpc.Code_CODE_UNAUTHENTICATED:
+		cause = syscall.EACCES
+	case rpc.Code_CODE_ALREADY_EXISTS:
+		cause = syscall.EEXIST
+	case rpc.Code_CODE_LOCKED:
+		cause = errLocked
+	case rpc.Code_CODE_INSUFFICIENT_STORAGE:
+		cause = syscall.EDQUOT
+	case rpc.Code_CODE_FAILED_PRECONDITION, rpc.Code_CODE_ABORTED:
+		cause = errPrecondition
+	case rpc.Code_CODE_UNAVAILABLE, rpc.Code_CODE_DEADLINE_EXCEEDED:
+		cause = errUnavailable
+	case rpc.Code_CODE_UNIMPLEMENTED:
+		cause = errors.ErrUnsupported
+	default:
+		return &statusError{
+			msg:    fmt.Sprintf("%s failed: %s", op, st.GetMessage()),
+			status: sftp.ErrSSHFxFailure,
+			err:    fmt.Errorf("%s: %s", st.GetCode(), st.GetMessage()),
+		}
+	}
+
+	return newStatusError(op, cause)
+}
+
+// httpError returns the error for the data gateway request op, which answered with the given status code
+func httpError(op string, code int) error {
+	var cause error
+	switch code {
+	case http.StatusNotFound, http.StatusGone:
+		cause = syscall.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		cause = syscall.EACCES
+	case http.StatusLocked:
+		cause = errLocked
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		cause = syscall.EDQUOT
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		cause = errPrecondition
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		cause = errUnavailable
+	case http.StatusNotImplemented:
+		cause = errors.ErrUnsupported
+	default:
+		return &statusError{
+			msg:    fmt.Sprintf("%s failed with status %d", op, code),
+			status: sftp.ErrSSHFxFailure,
+			err:    fmt.Errorf("http status %d", code),
+		}
+	}
+
+	return newStatusError(op, cause)
+}
+
+// sftpError translates an error returned to pkg/sftp into one with the proper status code. Errors of the
+// package which stand for a missing resource or a refused operation, like the errors of the virtual
+// directories, would otherwise be reported as generic failures.
+func sftpError(err error) error {
+	var se *statusError
+	switch {
+	case err == nil, errors.As(err, &se), errors.Is(err, io.EOF):
+		return err
+	case errors.Is(err, os.ErrNotExist):
+		return &statusError{msg: err.Error(), status: sftp.ErrSSHFxNoSuchFile, err: err}
+	case errors.Is(err, os.ErrPermission):
+		return &statusError{msg: err.Error(), status: sftp.ErrSSHFxPermissionDenied, err: err}
+	case errors.Is(err, errors.ErrUnsupported):
+		return &statusError{msg: err.Error(), status: sftp.ErrSSHFxOpUnsupported, err: err}
+	}
+
+	// the gateway itself can't be reached
+	if s, ok := status.FromError(err); ok && (s.Code() == codes.Unavailable || s.Code() == codes.DeadlineExceeded) {
+		return &statusError{msg: "gateway: " + errUnavailable.Error(), status: sftp.ErrSSHFxFailure, err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+)
+
+// execCommands maps the commands which can be run through ssh exec requests to the algorithm they hash with
+var execCommands = map[string]string{
+	"md5sum":  "md5",
+	"sha1sum": "sha1",
+}
+
+// Exec runs the command of an ssh exec request for the user authenticated in authCtx and returns its exit status.
+// There is no shell and no binary is run. scp is served by the built-in implementation of the scp protocol.
+// md5sum and sha1sum print hashes like coreutils does, clients like rclone use them to hash remote files.
+// "echo ... | md5sum" hashes the echoed line, as a shell would. rclone sends it to find out whether
+// hashing is supported.
+func (ocfs *OpenCloudFS) Exec(authCtx context.Context, logger zerolog.Logger, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "Interactive shells are not supported, only sftp, scp, md5sum and sha1sum are available.")
+		return 1
+	}
+
+	if args[0] == "echo" {
+		pipe := slices.Index(args, "|")
+		if pipe < 0 || pipe == len(args)-1 {
+			fmt.Fprintln(stderr, "Command not supported, only scp, md5sum and sha1sum are available.")
+			return 1
+		}
+
+		stdin = strings.NewReader(strings.Join(args[1:pipe], " ") + "\n")
+		args = args[pipe+1:]
+	}
+
+	algo, ok := execCommands[args[0]]
+	if (!ok && args[0] != "scp") || slices.Contains(args, "|") {
+		fmt.Fprintf(stderr, "Command %q not supported, only scp, md5sum and sha1sum are available.\n", args[0])
+		return 1
+	}
+
+	fs, err := ocfs.newRoot(authCtx, logger)
+	if err != nil {
+		logger.Error().Err(err).Msg("Could not start the session")
+		fmt.Fprintln(stderr, "The session could not be started.")
+		return 1
+	}
+	fs.log.Debug().Strs("args", args).Msg("exec called")
+
+	if args[0] == "scp" {
+		return fs.scp(args[1:], stdin, stdout, stderr)
+	}
+
+	return fs.hashFiles(args[0], algo, args[1:], stdin, stdout, stderr)
+}
+
+// hashFiles prints the checksums of the given files the way coreutils does. Without files, stdin is hashed.
+func (fs *root) hashFiles(cmd, algo string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var files []string
+	options := true
+	for _, arg := range args {
+		switch {
+		case options && arg == "--":
+			options = false
+		case options && strings.HasPrefix(arg, "-") && arg != "-":
+			fmt.Fprintf(stderr, "%s: option %s is not supported\n", cmd, arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	for _, name := range files {
+		var sum []byte
+		var err error
+		if name == "-" {
+			sum, err = hashBlocks(stdin, checksumAlgorithms[algo], 0)
+		} else {
+			var p string
+			if p, err = fs.expandPath(name); err == nil {
+				sum, err = fs.fileChecksum(p, algo)
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s: %s\n", cmd, name, execErrorText(err))
+			status = 1
+			continue
+		}
+
+		fmt.Fprintln(stdout, checksumLine(sum, name))
+	}
+
+	return status
+}
+
+// checksumLine formats a checksum line like coreutils, which escapes backslashes and line breaks in
+// the file name and marks such lines with a leading backslash
+func checksumLine(sum []byte, name string) string {
+	line := hex.EncodeToString(sum) + "  "
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return line + name
+	}
+
+	escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+	return "\\" + line + escaped
+}
+
+// execErrorText returns the message coreutils prints for err
+func execErrorText(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, syscall.EISDIR):
+		return "Is a directory"
+	case errors.Is(err, os.ErrPermission):
+		return "Permission denied"
+	default:
+		return err.Error()
+	}
+}
@@ -1,320 +1,438 @@
 package vfs
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 
-	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
 	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
-	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/pkg/sftp"
 	"google.golang.org/grpc/metadata"
 )
 
-// sftpFileHandler implements io.ReaderAt and io.WriterAt for SFTP file operations
+// sftpFileHandler implements io.ReaderAt and io.WriterAt for SFTP file operations.
+// Writes are buffered and uploaded once, when the client closes the handle.
 type sftpFileHandler struct {
 	fs       *root
 	ref      *provider.Reference
 	filepath string
-	flags    uint32
-
-	// Caching
-	mu         sync.RWMutex
-	cache      []byte
-	cacheValid bool
-	fileSize   int64
-	etag       string
-
-	// HTTP client for data gateway operations
-	httpClient *http.Client
+	flags    sftp.FileOpenFlags
+
+	mu   sync.Mutex
+	etag string
+	// reader serves reads of content which has not been written through this handle
+	reader *rangeReader
+	// buffer holds the content written through this handle, nil until the first write
+	buffer *writeBuffer
+	// appendBase is the size of the content the buffer started out with
+	appendBase int64
+	// appendMode is decided by the first write to a handle opened for appending
+	appendMode appendMode
+	// aborted is set when the session ended with the handle still open
+	aborted bool
+	// closed is set once the client closed the handle, it can no longer be held
+	closed bool
+	// held counts the extended requests using the handle, which Close waits for
+	held sync.WaitGroup
+	// mtime is set by the client while the handle is open, it is applied after the content has been stored
+	mtime time.Time
 }
 
 // newSftpFileHandler creates a new file handler
-func newSftpFileHandler(fs *root, ref *provider.Reference, filepath string, flags uint32) *sftpFileHandler {
+func newSftpFileHandler(fs *root, ref *provider.Reference, filepath string, flags sftp.FileOpenFlags) *sftpFileHandler {
 	return &sftpFileHandler{
 		fs:       fs,
 		ref:      ref,
 		filepath: filepath,
 		flags:    flags,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					MinVersion:         tls.VersionTLS12,
-					InsecureSkipVerify: true, // TODO: make configurable
-				},
-			},
-			Timeout: 30 * time.Second,
-		},
 	}
 }
 
+// writable reports whether the handle has been opened for writing
+func (h *sftpFileHandler) writable() bool {
+	return h.flags.Write || h.flags.Append
+}
+
 // ReadAt implements io.ReaderAt
 func (h *sftpFileHandler) ReadAt(b []byte, off int64) (n int, err error) {
-	h.mu.RLock()
-	if h.cacheValid && h.cache != nil {
-		h.mu.RUnlock()
-		return h.readFromCache(b, off)
+	h.mu.Lock()
+	buffer := h.buffer
+	h.mu.Unlock()
+
+	if buffer != nil {
+		return buffer.ReadAt(b, off)
 	}
-	h.mu.RUnlock()
 
-	// Need to download the file
-	if err := h.downloadFile(); err != nil {
+	reader, err := h.rangeReader()
+	if err != nil {
 		return 0, err
 	}
 
-	return h.readFromCache(b, off)
+	return reader.ReadAt(b, off)
 }
 
 // WriteAt implements io.WriterAt
 func (h *sftpFileHandler) WriteAt(b []byte, off int64) (n int, err error) {
-	// For writes, we need to ensure we have the current file content
-	if !h.cacheValid {
-		// Try to download existing file, ignore not found errors
-		_ = h.downloadFile()
+	buffer, err := h.writeBuffer()
+	if err != nil {
+		return 0, err
 	}
 
+	if h.flags.Append && h.appendsAtEnd(off) {
+		return buffer.Append(b)
+	}
+
+	return buffer.WriteAt(b, off)
+}
+
+// appendMode tells how writes to a handle opened for appending are placed
+type appendMode int
+
+const (
+	appendUndecided appendMode = iota
+	// appendAtOffset writes at the offsets sent by the client, which continue the content
+	appendAtOffset
+	// appendAtEnd ignores the offsets and writes at the end of the content
+	appendAtEnd
+)
+
+// appendsAtEnd reports whether a write at off to a handle opened for appending goes to the end of the
+// content. Clients which pipeline their appends, like OpenSSH when resuming an upload, send the offsets
+// past the content they expect, which keeps the writes in order when they are handled out of order.
+// Clients which count from zero get their writes appended in the order they are handled.
+func (h *sftpFileHandler) appendsAtEnd(off int64) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	// Extend cache if necessary
-	requiredSize := off + int64(len(b))
-	if int64(len(h.cache)) < requiredSize {
-		newCache := make([]byte, requiredSize)
-		copy(newCache, h.cache)
-		h.cache = newCache
-		h.fileSize = requiredSize
+	if h.appendMode == appendUndecided {
+		h.appendMode = appendAtEnd
+		if off >= h.appendBase {
+			h.appendMode = appendAtOffset
+		}
 	}
 
-	// Write to cache
-	n = copy(h.cache[off:], b)
+	return h.appendMode == appendAtEnd
+}
 
-	// Upload the modified content
-	if err := h.uploadFile(); err != nil {
-		return n, err
+// Truncate implements file truncation
+func (h *sftpFileHandler) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size not allowed")
+	}
+
+	buffer, err := h.writeBuffer()
+	if err != nil {
+		return err
 	}
 
-	return n, nil
+	return buffer.Truncate(size)
 }
 
-// readFromCache reads data from the cache
-func (h *sftpFileHandler) readFromCache(b []byte, off int64) (n int, err error) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// TransferError implements sftp.TransferError, it is called when the session ends
+// while the handle is still open. Buffered writes are then not uploaded, but kept for
+// resuming if enabled.
+func (h *sftpFileHandler) TransferError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	if off >= h.fileSize {
-		return 0, io.EOF
-	}
+	h.aborted = true
+
+	h.fs.log.Debug().
+		Err(err).
+		Str("path", h.filepath).
+		Msg("Transfer aborted")
+}
 
-	n = copy(b, h.cache[off:])
-	if off+int64(n) >= h.fileSize {
-		return n, io.EOF
+// hold keeps the handle from being closed until release is called. The request server only closes a
+// handle once the requests it handles for it are done, extended requests like copy-data bypass it.
+func (h *sftpFileHandler) hold() (release func(), err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, sftpext.ErrBadHandle
 	}
 
-	return n, nil
+	h.held.Add(1)
+	return h.held.Done, nil
 }
 
-// downloadFile downloads the file content and caches it
-func (h *sftpFileHandler) downloadFile() error {
-	client, err := h.fs.gwSelector.Next()
-	if err != nil {
+// Close implements io.Closer, it is called by the request server when the client closes the handle.
+// Buffered writes are uploaded here, so upload errors reach the client as a failed close.
+func (h *sftpFileHandler) Close() error {
+	h.fs.removeWriter(h)
+
+	// extended requests still writing to the buffer finish before it is uploaded
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.held.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	if h.reader != nil {
+		err = h.reader.Close()
+		h.reader = nil
+	}
+
+	if h.buffer == nil {
+		if err == nil && !h.aborted && h.fs.staging != nil && h.flags.Creat && !h.flags.Excl {
+			// nothing was written, but an atomic upload still has to create the file
+			err = h.createEmpty()
+		}
+		if err == nil && !h.aborted {
+			err = h.applyMtime()
+		}
 		return err
 	}
 
-	// First, stat the file to get its info
-	statResp, err := client.Stat(h.fs.authCtx, &provider.StatRequest{
-		Ref: h.ref,
-	})
-	if err != nil {
+	defer func() {
+		_ = h.buffer.Close()
+		h.buffer = nil
+	}()
+
+	if h.aborted {
+		h.keepPartial()
 		return err
 	}
-	if statResp.Status.Code != rpc.Code_CODE_OK && statResp.Status.Code != rpc.Code_CODE_NOT_FOUND {
-		return fmt.Errorf("stat failed: %s", statResp.Status.Message)
+
+	if err := h.uploadFile(); err != nil {
+		return err
+	}
+
+	return h.applyMtime()
+}
+
+// setstat applies attribute changes to the handle. A new size is applied to the buffered content,
+// a new modification time is stored when the handle is closed.
+func (h *sftpFileHandler) setstat(flags sftp.FileAttrFlags, attrs *sftp.FileStat) error {
+	if flags.Size {
+		if err := h.Truncate(int64(attrs.Size)); err != nil {
+			return err
+		}
 	}
 
-	// If file doesn't exist, initialize empty cache
-	if statResp.Status.Code == rpc.Code_CODE_NOT_FOUND {
+	if flags.Acmodtime {
 		h.mu.Lock()
-		h.cache = []byte{}
-		h.cacheValid = true
-		h.fileSize = 0
+		h.mtime = attrs.ModTime()
 		h.mu.Unlock()
-		return nil
 	}
 
-	// Initiate download
-	resp, err := client.InitiateFileDownload(h.fs.authCtx, &provider.InitiateFileDownloadRequest{
-		Ref: h.ref,
-	})
-	if err != nil {
-		return err
-	}
-	if resp.Status.Code != rpc.Code_CODE_OK {
-		return fmt.Errorf("initiate download failed: %s", resp.Status.Message)
-	}
+	return nil
+}
 
-	// Find the simple/spaces protocol endpoint
-	var downloadEndpoint, downloadToken string
-	for _, proto := range resp.GetProtocols() {
-		if proto.GetProtocol() == "simple" || proto.GetProtocol() == "spaces" {
-			downloadEndpoint = proto.GetDownloadEndpoint()
-			downloadToken = proto.GetToken()
-			break
-		}
+// discard drops the buffered content without uploading it
+func (h *sftpFileHandler) discard() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.buffer != nil {
+		_ = h.buffer.Close()
+		h.buffer = nil
 	}
+}
 
-	if downloadEndpoint == "" {
-		return fmt.Errorf("no suitable download protocol found")
+// rangeReader returns the reader for the file, creating it on first use
+func (h *sftpFileHandler) rangeReader() (*rangeReader, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.reader != nil {
+		return h.reader, nil
 	}
 
-	// Create HTTP request
-	httpReq, err := http.NewRequest("GET", downloadEndpoint, nil)
+	info, err := h.statFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if info == nil {
+		return nil, os.ErrNotExist
+	}
+
+	h.etag = info.GetEtag()
+	h.reader = newRangeReader(h.fs, h.ref, int64(info.GetSize()))
+	return h.reader, nil
+}
+
+// writeBuffer returns the write buffer, creating it on first use. Unless the handle
+// was opened with the truncate flag, the buffer starts out with the current content.
+func (h *sftpFileHandler) writeBuffer() (*writeBuffer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	// Add auth token from context
-	if token, err := h.extractAuthToken(); err == nil {
-		httpReq.Header.Add("X-Access-Token", token)
+	if h.buffer != nil {
+		return h.buffer, nil
 	}
 
-	if downloadToken != "" {
-		httpReq.Header.Add("X-Reva-Transfer", downloadToken)
+	if h.fs.resumes != nil {
+		key := resumeKey(h.fs.userID, h.ref)
+		if h.flags.Trunc {
+			h.fs.resumes.discard(key)
+		} else if buffer, err := h.resumeBuffer(key); err != nil || buffer != nil {
+			if buffer != nil {
+				// resuming clients append past the kept content, which is the size reported to them
+				h.buffer, h.appendBase = buffer, buffer.Size()
+			}
+			return buffer, err
+		}
+	}
+
+	buffer := h.fs.spool.newBuffer()
+	if !h.flags.Trunc {
+		if err := h.loadContent(buffer); err != nil {
+			_ = buffer.Close()
+			return nil, err
+		}
 	}
 
-	// Execute download
-	httpResp, err := h.httpClient.Do(httpReq)
+	h.buffer, h.appendBase = buffer, buffer.Size()
+	return h.buffer, nil
+}
+
+// resumeBuffer returns a buffer holding the content of an interrupted upload of the file, if one was kept
+func (h *sftpFileHandler) resumeBuffer(key string) (*writeBuffer, error) {
+	info, err := h.statFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer httpResp.Body.Close()
 
-	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status: %d", httpResp.StatusCode)
+	p, data := h.fs.resumes.claim(key, info.GetEtag())
+	if p == nil {
+		return nil, nil
 	}
 
-	// Read the content
-	content, err := io.ReadAll(httpResp.Body)
+	buffer, err := h.fs.spool.adopt(data, p.Size)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Update cache
-	h.mu.Lock()
-	h.cache = content
-	h.cacheValid = true
-	h.fileSize = int64(len(content))
-	h.etag = httpResp.Header.Get("ETag")
-	h.mu.Unlock()
+	h.etag = info.GetEtag()
 
 	h.fs.log.Debug().
 		Str("path", h.filepath).
-		Int64("size", h.fileSize).
-		Msg("File downloaded and cached")
+		Int64("size", p.Size).
+		Msg("Resuming interrupted upload")
 
-	return nil
+	return buffer, nil
 }
 
-// uploadFile uploads the cached content to storage
-func (h *sftpFileHandler) uploadFile() error {
-	client, err := h.fs.gwSelector.Next()
-	if err != nil {
-		return err
+// keepPartial hands the content written without gaps so far to the resume store
+func (h *sftpFileHandler) keepPartial() {
+	if h.fs.resumes == nil {
+		return
 	}
 
-	// Prepare upload request
-	opaque := &types.Opaque{
-		Map: map[string]*types.OpaqueEntry{
-			"Upload-Length": {
-				Decoder: "plain",
-				Value:   []byte(strconv.FormatInt(h.fileSize, 10)),
-			},
-		},
-	}
-
-	uploadReq := &provider.InitiateFileUploadRequest{
-		Ref:    h.ref,
-		Opaque: opaque,
+	size := h.buffer.Prefix()
+	if size == 0 {
+		return
 	}
 
-	// Add etag for conflict detection if we have one
-	if h.etag != "" {
-		uploadReq.Options = &provider.InitiateFileUploadRequest_IfMatch{
-			IfMatch: h.etag,
-		}
+	info, err := h.statFile()
+	if err != nil {
+		h.fs.log.Debug().Err(err).Str("path", h.filepath).Msg("Could not keep interrupted upload")
+		return
+	}
+
+	err = h.fs.resumes.save(resumeKey(h.fs.userID, h.ref), &partialUpload{
+		User:  h.fs.userID,
+		Space: h.ref.GetResourceId().GetSpaceId(),
+		Path:  h.filepath,
+		Size:  size,
+		Etag:  info.GetEtag(),
+		Saved: time.Now(),
+	}, h.buffer)
+	if err != nil {
+		h.fs.log.Debug().Err(err).Str("path", h.filepath).Msg("Could not keep interrupted upload")
 	}
+}
 
-	resp, err := client.InitiateFileUpload(h.fs.authCtx, uploadReq)
+// loadContent copies the current file content, if any, into the buffer
+func (h *sftpFileHandler) loadContent(buffer io.WriterAt) error {
+	info, err := h.statFile()
 	if err != nil {
 		return err
 	}
-	if resp.Status.Code != rpc.Code_CODE_OK {
-		return fmt.Errorf("initiate upload failed: %s", resp.Status.Message)
+	if info == nil || info.GetSize() == 0 {
+		return nil
 	}
 
-	// Find the simple/spaces protocol endpoint
-	var uploadEndpoint, uploadToken string
-	for _, proto := range resp.GetProtocols() {
-		if proto.GetProtocol() == "simple" || proto.GetProtocol() == "spaces" {
-			uploadEndpoint = proto.GetUploadEndpoint()
-			uploadToken = proto.GetToken()
-			break
-		}
-	}
+	h.etag = info.GetEtag()
 
-	if uploadEndpoint == "" {
-		return fmt.Errorf("no suitable upload protocol found")
-	}
+	reader := newRangeReader(h.fs, h.ref, int64(info.GetSize()))
+	defer reader.Close()
 
-	// Create HTTP request
-	httpReq, err := http.NewRequest("PUT", uploadEndpoint, bytes.NewReader(h.cache[:h.fileSize]))
-	if err != nil {
+	if _, err := io.Copy(io.NewOffsetWriter(buffer, 0), io.NewSectionReader(reader, 0, int64(info.GetSize()))); err != nil {
 		return err
 	}
 
-	httpReq.ContentLength = h.fileSize
+	h.fs.log.Debug().
+		Str("path", h.filepath).
+		Uint64("size", info.GetSize()).
+		Msg("Existing content loaded into write buffer")
 
-	// Add auth token from context
-	if token, err := h.extractAuthToken(); err == nil {
-		httpReq.Header.Add("X-Access-Token", token)
-	}
+	return nil
+}
 
-	if uploadToken != "" {
-		httpReq.Header.Add("X-Reva-Transfer", uploadToken)
-	}
+// statFile returns the resource info of the file, or nil if it does not exist
+func (h *sftpFileHandler) statFile() (*provider.ResourceInfo, error) {
+	return h.fs.statRef(h.ref)
+}
 
-	// Execute upload
-	httpResp, err := h.httpClient.Do(httpReq)
+// uploadFile uploads the buffered content to storage
+func (h *sftpFileHandler) uploadFile() error {
+	size := h.buffer.Size()
+
+	var etag string
+	var err error
+	if h.fs.staging != nil {
+		etag, err = h.fs.publish(h.ref, h.buffer, size, h.etag)
+	} else {
+		etag, err = h.fs.upload(h.ref, h.buffer, size, h.etag)
+	}
 	if err != nil {
 		return err
 	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(httpResp.Body)
-		return fmt.Errorf("upload failed with status %d: %s", httpResp.StatusCode, string(body))
-	}
 
-	// Update etag from response
-	if newEtag := httpResp.Header.Get("ETag"); newEtag != "" {
-		h.etag = newEtag
+	if etag != "" {
+		h.etag = etag
 	}
 
 	h.fs.log.Debug().
 		Str("path", h.filepath).
-		Int64("size", h.fileSize).
+		Int64("size", size).
 		Msg("File uploaded successfully")
 
 	return nil
 }
 
+// applyMtime sets the modification time requested by the client, if any
+func (h *sftpFileHandler) applyMtime() error {
+	if h.mtime.IsZero() {
+		return nil
+	}
+
+	return h.fs.setMtime(h.ref, h.mtime)
+}
+
+// createEmpty creates the file without content, unless it exists already
+func (h *sftpFileHandler) createEmpty() error {
+	info, err := h.statFile()
+	if err != nil || info != nil {
+		return err
+	}
+
+	return h.fs.touch(h.ref, false)
+}
+
 // extractAuthToken extracts the auth token from the context
-func (h *sftpFileHandler) extractAuthToken() (string, error) {
-	md, ok := metadata.FromOutgoingContext(h.fs.authCtx)
+func extractAuthToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromOutgoingContext(ctx)
 	if !ok {
 		return "", fmt.Errorf("no metadata in context")
 	}
@@ -330,39 +448,3 @@ func (h *sftpFileHandler) extractAuthToken() (string, error) {
 
 	return tokens[0], nil
 }
-
-// Truncate implements file truncation
-func (h *sftpFileHandler) Truncate(size int64) error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if size < 0 {
-		return fmt.Errorf("negative size not allowed")
-	}
-
-	// Ensure we have the current content
-	if !h.cacheValid {
-		h.mu.Unlock()
-		if err := h.downloadFile(); err != nil {
-			return err
-		}
-		h.mu.Lock()
-	}
-
-	// Resize cache
-	if size == 0 {
-		h.cache = []byte{}
-	} else if size < int64(len(h.cache)) {
-		h.cache = h.cache[:size]
-	} else {
-		// Extend with zeros
-		newCache := make([]byte, size)
-		copy(newCache, h.cache)
-		h.cache = newCache
-	}
-
-	h.fileSize = size
-
-	// Upload the truncated file
-	return h.uploadFile()
-}
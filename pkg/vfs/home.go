@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	ctxpkg "github.com/opencloud-eu/reva/v2/pkg/ctx"
+)
+
+// homeDir returns the path of the personal space of the user, which sessions start in.
+// Users without a personal space start in the root.
+func (fs *root) homeDir() (string, error) {
+	user, ok := ctxpkg.ContextGetUser(fs.authCtx)
+	if !ok {
+		return "/", nil
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return "", err
+	}
+
+	lsRes, err := client.ListStorageSpaces(fs.authCtx, spacelookup.FilterForPersonalSpace(user.GetId()))
+	if err != nil {
+		return "", err
+	}
+	if err := cs3Error("list spaces", lsRes.GetStatus()); err != nil {
+		return "", err
+	}
+
+	for _, spc := range lsRes.GetStorageSpaces() {
+		if spc.GetOwner().GetId().GetOpaqueId() == fs.userID {
+			return fs.mountPath(spc.GetId().GetOpaqueId())
+		}
+	}
+
+	return "/", nil
+}
+
+// mountPath returns the path the space with the given id is mounted at, or the root if it is hidden
+func (fs *root) mountPath(spaceID string) (string, error) {
+	spaces, err := fs.listStorageSpaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range fs.mounts(spaces) {
+		if m.space.GetId().GetOpaqueId() == spaceID {
+			return m.path, nil
+		}
+	}
+
+	return "/", nil
+}
+
+// RealPath resolves p to an absolute path. Relative paths start at the home directory of the user.
+func (fs *root) RealPath(p string) (string, error) {
+	fs.log.Debug().
+		Str("path", p).
+		Msg("RealPath called")
+
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+
+	return path.Join(fs.home, p), nil
+}
+
+// expandPath resolves p like a shell does. Relative paths start at the home directory and a leading
+// "~" or "~user" is the home directory, which is only known for the user of the session.
+func (fs *root) expandPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "~") {
+		return fs.RealPath(p)
+	}
+
+	user, rest, _ := strings.Cut(p[1:], "/")
+	if user != "" && user != fs.username {
+		return "", os.ErrNotExist
+	}
+
+	return path.Join(fs.home, rest), nil
+}
+
+// handleExpandPath handles expand-path@openssh.com requests, which clients send to resolve "~"
+func (fs *root) handleExpandPath(req *sftpext.Request) (string, error) {
+	p, err := req.String()
+	if err != nil {
+		return "", err
+	}
+
+	return fs.expandPath(p)
+}
+
+// handleHomeDirectory handles home-directory requests. An empty user name asks for the home directory
+// of the user of the session, which is the only one known.
+func (fs *root) handleHomeDirectory(req *sftpext.Request) (string, error) {
+	user, err := req.String()
+	if err != nil {
+		return "", err
+	}
+
+	if user != "" && user != fs.username {
+		return "", os.ErrNotExist
+	}
+
+	return fs.home, nil
+}
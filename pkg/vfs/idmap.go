@@ -0,0 +1,300 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
+	grouppb "github.com/cs3org/go-cs3apis/cs3/identity/group/v1beta1"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+)
+
+const (
+	// idCacheTTL bounds how long a resolved owner is kept, so that renamed users and spaces show up eventually
+	idCacheTTL = 10 * time.Minute
+	// hashedIDBase is the lowest id derived from a CS3 user id, above the ids local users and groups usually have
+	hashedIDBase = 1 << 20
+)
+
+// owner is the numeric uid and gid of a CS3 user along with their names, empty if they could not be resolved
+type owner struct {
+	uid   uint32
+	gid   uint32
+	user  string
+	group string
+
+	expires time.Time
+}
+
+// idMap maps CS3 user ids to numeric ids and names, and numeric ids back to names.
+// It is shared by all sessions, as the mapping does not depend on the user looking at it.
+type idMap struct {
+	mu     sync.Mutex
+	owners map[string]owner
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newIDMap() *idMap {
+	return &idMap{
+		owners: map[string]owner{},
+		// resources without an owner, like the directories of the layout, belong to root
+		users:  map[uint32]string{0: "root"},
+		groups: map[uint32]string{0: "root"},
+	}
+}
+
+// cached returns the owner resolved for key, if it has not expired
+func (m *idMap) cached(key string) (owner, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.owners[key]
+	if !ok || time.Now().After(o.expires) {
+		return owner{}, false
+	}
+
+	return o, true
+}
+
+// add caches the owner resolved for key and records its names for the lookup by numeric id
+func (m *idMap) add(key string, o owner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o.expires = time.Now().Add(idCacheTTL)
+	m.owners[key] = o
+	if o.user != "" {
+		m.users[o.uid] = o.user
+	}
+	if o.group != "" {
+		m.groups[o.gid] = o.group
+	}
+}
+
+// userName returns the name of the user with the numeric id uid, empty if it is not known
+func (m *idMap) userName(uid uint32) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.users[uid]
+}
+
+// groupName returns the name of the group with the numeric id gid, empty if it is not known
+func (m *idMap) groupName(gid uint32) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.groups[gid]
+}
+
+// hashedID derives a numeric id from a CS3 user id which has no uid number. The id is stable across
+// sessions and restarts, distinct ids are only told apart as far as the hash allows.
+func hashedID(id *userpb.UserId) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id.GetIdp() + "!" + id.GetOpaqueId()))
+
+	return hashedIDBase + h.Sum32()%(math.MaxInt32-hashedIDBase)
+}
+
+// idName turns a display name into a name which fits into a column of a long listing
+func idName(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
+
+// owner returns the owner of resources owned by the CS3 user id. Users keep their uid and gid numbers if they
+// have them, otherwise the ids are derived from the user id and the user gets a group of their own. Project spaces
+// are owned by the space itself, their files show the name of the space as owner and group.
+func (fs *root) owner(id *userpb.UserId) owner {
+	if id.GetOpaqueId() == "" {
+		return owner{}
+	}
+
+	key := id.GetType().String() + ":" + id.GetIdp() + "!" + id.GetOpaqueId()
+	if o, ok := fs.ids.cached(key); ok {
+		return o
+	}
+
+	var o owner
+	var err error
+	if id.GetType() == userpb.UserType_USER_TYPE_SPACE_OWNER {
+		o, err = fs.spaceOwner(id)
+	} else {
+		o, err = fs.userOwner(id)
+	}
+	if err != nil {
+		// the owner is shown by its numeric id, and not resolved again until the entry expires
+		fs.log.Debug().Err(err).Str("owner", id.GetOpaqueId()).Msg("Could not resolve owner")
+		o = owner{uid: hashedID(id), gid: hashedID(id)}
+	}
+
+	fs.ids.add(key, o)
+	return o
+}
+
+// userOwner resolves a user through the gateway
+func (fs *root) userOwner(id *userpb.UserId) (owner, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return owner{}, err
+	}
+
+	userResp, err := client.GetUser(fs.authCtx, &userpb.GetUserRequest{
+		UserId:                 id,
+		SkipFetchingUserGroups: true,
+	})
+	if err != nil {
+		return owner{}, err
+	}
+
+	if err := cs3Error("get user", userResp.GetStatus()); err != nil {
+		return owner{}, err
+	}
+
+	user := userResp.GetUser()
+	o := owner{
+		uid:  hashedID(id),
+		user: idName(user.GetUsername()),
+	}
+	if n := user.GetUidNumber(); n > 0 && n <= math.MaxUint32 {
+		o.uid = uint32(n)
+	}
+
+	n := user.GetGidNumber()
+	if n <= 0 || n > math.MaxUint32 {
+		// a group of their own, like the user private groups of most systems
+		o.gid, o.group = o.uid, o.user
+		return o, nil
+	}
+
+	o.gid = uint32(n)
+	group, err := fs.groupByGid(o.gid)
+	if err != nil {
+		fs.log.Debug().Err(err).Uint32("gid", o.gid).Msg("Could not resolve group")
+		return o, nil
+	}
+	o.group = idName(group.GetGroupName())
+
+	return o, nil
+}
+
+// groupByGid resolves a group by its gid number through the gateway
+func (fs *root) groupByGid(gid uint32) (*grouppb.Group, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	groupResp, err := client.GetGroupByClaim(fs.authCtx, &grouppb.GetGroupByClaimRequest{
+		Claim:               "gid_number",
+		Value:               strconv.FormatUint(uint64(gid), 10),
+		SkipFetchingMembers: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs3Error("get group", groupResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	return groupResp.GetGroup(), nil
+}
+
+// spaceOwner resolves the owner of a project space, which is named after the space
+func (fs *root) spaceOwner(id *userpb.UserId) (owner, error) {
+	spaces, err := fs.listStorageSpaces()
+	if err != nil {
+		return owner{}, err
+	}
+
+	for _, spc := range spaces {
+		if spc.GetRoot().GetSpaceId() != id.GetOpaqueId() {
+			continue
+		}
+
+		uid := hashedID(id)
+		name := idName(spc.GetName())
+		return owner{uid: uid, gid: uid, user: name, group: name}, nil
+	}
+
+	return owner{}, os.ErrNotExist
+}
+
+// setOwners fills in the numeric ids of the owners of fileInfos
+func (fs *root) setOwners(fileInfos []os.FileInfo) {
+	for i, info := range fileInfos {
+		fi, ok := info.(fileInfo)
+		if !ok || fi.owner == nil {
+			continue
+		}
+
+		o := fs.owner(fi.owner)
+		fi.uid, fi.gid = o.uid, o.gid
+		fileInfos[i] = fi
+	}
+}
+
+// LookupUserName returns the name shown in the owner column of long listings for the numeric id uid
+func (fs *root) LookupUserName(uid string) string {
+	n, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return uid
+	}
+
+	if name := fs.ids.userName(uint32(n)); name != "" {
+		return name
+	}
+
+	return uid
+}
+
+// LookupGroupName returns the name shown in the group column of long listings for the numeric id gid
+func (fs *root) LookupGroupName(gid string) string {
+	n, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return gid
+	}
+
+	if name := fs.ids.groupName(uint32(n)); name != "" {
+		return name
+	}
+
+	return gid
+}
+
+// handleUsersGroupsByID handles users-groups-by-id@openssh.com requests, which the OpenSSH sftp client
+// sends to show names in long listings. Names are known for the ids of owners which have been listed before,
+// unknown ids get an empty name.
+func (fs *root) handleUsersGroupsByID(req *sftpext.Request) ([]byte, error) {
+	uids, err := req.String()
+	if err != nil {
+		return nil, err
+	}
+	gids, err := req.String()
+	if err != nil {
+		return nil, err
+	}
+	if len(uids)%4 != 0 || len(gids)%4 != 0 {
+		return nil, os.ErrInvalid
+	}
+
+	var users []byte
+	for b := []byte(uids); len(b) > 0; b = b[4:] {
+		users = sftpext.AppendString(users, fs.ids.userName(binary.BigEndian.Uint32(b)))
+	}
+
+	var groups []byte
+	for b := []byte(gids); len(b) > 0; b = b[4:] {
+		groups = sftpext.AppendString(groups, fs.ids.groupName(binary.BigEndian.Uint32(b)))
+	}
+
+	data := sftpext.AppendString(nil, string(users))
+	return sftpext.AppendString(data, string(groups)), nil
+}
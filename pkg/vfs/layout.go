@@ -0,0 +1,247 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/opencloud-eu/reva/v2/pkg/storagespace"
+	"github.com/opencloud-eu/reva/v2/pkg/utils"
+)
+
+// Ranks of spaces whose mount points collide. A space which ranks above all others keeps its name,
+// so that creating a project cannot move the personal space or the shares.
+const (
+	rankPersonal = iota
+	rankShares
+	rankProject
+	rankOther
+)
+
+// mount is a space mounted into the virtual root
+type mount struct {
+	// path is the absolute path the space, or the directory base within it, appears at
+	path  string
+	space *provider.StorageSpace
+	rank  int
+	// base is the path within the space which is mounted, the space root if empty
+	base string
+}
+
+// mounts returns the visible spaces at their mount points in the configured layout, sorted by path.
+// Spaces which would be mounted at the same path get the start of their id appended, all of them
+// unless one ranks above the others.
+func (fs *root) mounts(spaces []*provider.StorageSpace) []mount {
+	if fs.chroot != nil {
+		return fs.chrootMounts(spaces)
+	}
+
+	mounts := make([]mount, 0, len(spaces))
+	for _, spc := range spaces {
+		if !fs.layout.ShowDisabled && utils.ReadPlainFromOpaque(spc.GetOpaque(), "trashed") == "trashed" {
+			continue
+		}
+
+		if m, ok := fs.mountPoint(spc); ok {
+			mounts = append(mounts, m)
+		}
+	}
+
+	byPath := map[string][]int{}
+	for i, m := range mounts {
+		byPath[m.path] = append(byPath[m.path], i)
+	}
+
+	for p, idx := range byPath {
+		if len(idx) < 2 {
+			continue
+		}
+
+		slices.SortFunc(idx, func(a, b int) int {
+			if mounts[a].rank != mounts[b].rank {
+				return mounts[a].rank - mounts[b].rank
+			}
+			return strings.Compare(mounts[a].space.GetId().GetOpaqueId(), mounts[b].space.GetId().GetOpaqueId())
+		})
+
+		keep := mounts[idx[0]].rank < mounts[idx[1]].rank
+		for i, j := range idx {
+			if i == 0 && keep {
+				continue
+			}
+			mounts[j].path = p + " (" + shortSpaceID(mounts[j].space) + ")"
+		}
+	}
+
+	slices.SortFunc(mounts, func(a, b mount) int {
+		return strings.Compare(a.path, b.path)
+	})
+
+	return mounts
+}
+
+// mountPoint returns the mount of a space in the configured layout, before duplicates are resolved.
+// Spaces which have no place in the layout are not mounted.
+func (fs *root) mountPoint(spc *provider.StorageSpace) (mount, bool) {
+	m := mount{space: spc, rank: rankOther}
+	name := pathSegment(spc.GetName())
+	own := spc.GetOwner().GetId().GetOpaqueId() == fs.userID
+
+	switch spc.GetSpaceType() {
+	case "personal":
+		if own {
+			m.rank = rankPersonal
+		}
+	case "virtual":
+		m.rank = rankShares
+	case "project":
+		m.rank = rankProject
+	}
+
+	switch fs.layout.Root {
+	case config.LayoutAlias:
+		if alias := utils.ReadPlainFromOpaque(spc.GetOpaque(), "spaceAlias"); alias != "" {
+			segments := strings.Split(alias, "/")
+			for i := range segments {
+				segments[i] = pathSegment(segments[i])
+			}
+			m.path = path.Join(append([]string{"/"}, segments...)...)
+			return m, true
+		}
+		// spaces without an alias, like the shares, are mounted as in the typed layout
+		fallthrough
+	case config.LayoutTyped:
+		switch {
+		case spc.GetSpaceType() == "personal" && own:
+			m.path = "/personal"
+		case spc.GetSpaceType() == "personal":
+			m.path = path.Join("/users", name)
+		case spc.GetSpaceType() == "project":
+			m.path = path.Join("/projects", name)
+		case spc.GetSpaceType() == "virtual":
+			// the shares jail holds all received shares, as /shares/<name>
+			m.path = "/shares"
+		default:
+			return m, false
+		}
+	default:
+		m.path = path.Join("/", name)
+	}
+
+	return m, true
+}
+
+// findMount returns the mount containing p and the path of p relative to the space root,
+// or nil if p is not within a space. p is cleaned first, so that ".." can not reach above the
+// base of a mount.
+func findMount(mounts []mount, p string) (*mount, string) {
+	p = path.Clean("/" + p)
+
+	var found *mount
+	for i := range mounts {
+		m := &mounts[i]
+		inside := m.path == "/" || p == m.path || strings.HasPrefix(p, m.path+"/")
+		if inside && (found == nil || len(m.path) > len(found.path)) {
+			found = m
+		}
+	}
+
+	if found == nil {
+		return nil, ""
+	}
+
+	rel := path.Join("/", found.base, strings.TrimPrefix(p, found.path))
+	return found, rel
+}
+
+// virtualDir returns the entries of p if it is a directory of the layout which holds mount points
+// rather than being part of a space, like the root
+func virtualDir(mounts []mount, p string) ([]os.FileInfo, bool) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+
+	var entries []os.FileInfo
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		rest, ok := strings.CutPrefix(m.path, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+
+		name, sub, nested := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		fi := fileInfo{
+			name:  name,
+			mode:  os.FileMode(0775) | os.ModeDir,
+			isDir: true,
+		}
+		if !nested || sub == "" {
+			fi.owner = m.space.GetOwner().GetId()
+			if m.space.GetMtime() != nil {
+				fi.mtime = time.Unix(int64(m.space.GetMtime().Seconds), 0)
+			}
+		}
+
+		entries = append(entries, fi)
+	}
+
+	return entries, p == "/" || len(entries) > 0
+}
+
+// findSpace returns the space containing the absolute path p and the path relative to the space root.
+// The space is nil if p is not within a space. Paths within the trash of a space yield a *trashPathError,
+// paths within a versions view a *versionsPathError and paths within the pending shares a *pendingPathError.
+func (fs *root) findSpace(p string) (*provider.StorageSpace, string, error) {
+	spaces, err := fs.listStorageSpaces()
+	if err != nil {
+		return nil, "", err
+	}
+
+	m, rel := findMount(fs.mounts(spaces), p)
+	if m == nil {
+		return nil, "", nil
+	}
+
+	if rest, ok := trashPath(m, rel); ok {
+		return m.space, rel, &trashPathError{space: m.space, path: rest}
+	}
+	if name, ok := pendingPath(m.space, rel); ok {
+		return m.space, rel, &pendingPathError{name: name}
+	}
+	if loc, ok := fs.versionsPath(m, rel); ok {
+		return m.space, rel, loc
+	}
+
+	return m.space, rel, nil
+}
+
+// pathSegment turns a space name into a single path segment
+func pathSegment(name string) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+
+	return name
+}
+
+// shortSpaceID returns the start of the space id, which tells apart spaces with the same name
+func shortSpaceID(spc *provider.StorageSpace) string {
+	id := spc.GetId().GetOpaqueId()
+	if rid, err := storagespace.ParseID(id); err == nil && rid.GetSpaceId() != "" {
+		id = rid.GetSpaceId()
+	}
+
+	if len(id) > 8 {
+		id = id[:8]
+	}
+
+	return id
+}
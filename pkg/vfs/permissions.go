@@ -0,0 +1,77 @@
+package vfs
+
+import (
+	"os"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// fileMode returns the mode of a resource derived from the permissions the user has on it. The owner bits
+// reflect those permissions, group and others get the same read and search bits without write access, as
+// with the usual 0755 and 0644. Resources without a permission set get those modes.
+func fileMode(ri *provider.ResourceInfo) os.FileMode {
+	isDir := ri.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+
+	var mode os.FileMode = 0644
+	if isDir {
+		mode = 0755 | os.ModeDir
+	}
+
+	if ri.GetPermissionSet() == nil {
+		return mode
+	}
+
+	mode &^= 0777
+	if mayRead(ri) {
+		mode |= 0444
+		if isDir {
+			mode |= 0111
+		}
+	}
+	if mayWrite(ri) {
+		mode |= 0200
+	}
+
+	return mode
+}
+
+// mayRead reports whether the content of a resource can be read, which is the download of a file
+// or the listing of a directory. Resources without a permission set are left to the storage provider.
+func mayRead(ri *provider.ResourceInfo) bool {
+	perms := ri.GetPermissionSet()
+	if perms == nil {
+		return true
+	}
+
+	if ri.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return perms.GetListContainer()
+	}
+
+	return perms.GetInitiateFileDownload()
+}
+
+// mayWrite reports whether a resource can be changed, which is the upload of a file or the creation and
+// deletion of entries in a directory. Resources without a permission set are left to the storage provider.
+func mayWrite(ri *provider.ResourceInfo) bool {
+	perms := ri.GetPermissionSet()
+	if perms == nil {
+		return true
+	}
+
+	if ri.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return perms.GetCreateContainer() || perms.GetInitiateFileUpload() || perms.GetDelete()
+	}
+
+	return perms.GetInitiateFileUpload()
+}
+
+// mayDelete reports whether a resource can be deleted.
+// Resources without a permission set are left to the storage provider.
+func mayDelete(ri *provider.ResourceInfo) bool {
+	perms := ri.GetPermissionSet()
+	if perms == nil {
+		return true
+	}
+
+	return perms.GetDelete()
+}
@@ -0,0 +1,174 @@
+package vfs
+
+import (
+	"os"
+	"path"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	ctxpkg "github.com/opencloud-eu/reva/v2/pkg/ctx"
+)
+
+// spaceMetadataDir holds the image and readme of a space, it doesn't count as content
+const spaceMetadataDir = ".space"
+
+// projectName returns the name of the project space which would be mounted at p. Project spaces can only be
+// created and renamed in the flat and typed layouts, the alias of a space doesn't follow a rename.
+func (fs *root) projectName(p string) (string, bool) {
+	if fs.chroot != nil {
+		return "", false
+	}
+
+	dir, name := path.Split(p)
+	switch fs.layout.Root {
+	case config.LayoutFlat:
+		if dir != "/" {
+			return "", false
+		}
+	case config.LayoutTyped:
+		if dir != "/projects/" {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	if name == "" || pathSegment(name) != name {
+		return "", false
+	}
+
+	return name, true
+}
+
+// createProjectSpace creates a project space managed by the user, named after the directory created at p
+func (fs *root) createProjectSpace(p string) error {
+	name, ok := fs.projectName(p)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !fs.spaces.Create {
+		return os.ErrPermission
+	}
+
+	user, _ := ctxpkg.ContextGetUser(fs.authCtx)
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	createResp, err := client.CreateStorageSpace(fs.authCtx, &provider.CreateStorageSpaceRequest{
+		Type:  "project",
+		Name:  name,
+		Owner: user,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("create storage space", createResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("name", name).
+			Str("code", createResp.GetStatus().GetCode().String()).
+			Msg("Could not create project space")
+		return err
+	}
+
+	return nil
+}
+
+// renameProjectSpace renames the project space mounted by m after the directory at newpath,
+// which has to be where project spaces are mounted
+func (fs *root) renameProjectSpace(m *mount, mounts []mount, newpath string) error {
+	if m.space.GetSpaceType() != "project" || m.base != "" {
+		return os.ErrPermission
+	}
+
+	name, ok := fs.projectName(newpath)
+	if !ok || !fs.spaces.Rename {
+		return os.ErrPermission
+	}
+
+	if target, _ := findMount(mounts, newpath); target != nil {
+		return os.ErrExist
+	}
+	if _, ok := virtualDir(mounts, newpath); ok {
+		return os.ErrExist
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	updateResp, err := client.UpdateStorageSpace(fs.authCtx, &provider.UpdateStorageSpaceRequest{
+		StorageSpace: &provider.StorageSpace{
+			Id:   m.space.GetId(),
+			Root: m.space.GetRoot(),
+			Name: name,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("update storage space", updateResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("space", m.space.GetId().GetOpaqueId()).
+			Str("name", name).
+			Str("code", updateResp.GetStatus().GetCode().String()).
+			Msg("Could not rename project space")
+		return err
+	}
+
+	return nil
+}
+
+// disableProjectSpace disables the project space spc if it is empty. Disabled spaces are kept,
+// until they are deleted or enabled again in the web UI.
+func (fs *root) disableProjectSpace(spc *provider.StorageSpace) error {
+	if spc.GetSpaceType() != "project" || !fs.spaces.Disable {
+		return os.ErrPermission
+	}
+
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), "")
+	if err != nil {
+		return err
+	}
+
+	children, err := fs.listRef(&ref)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.GetName() != spaceMetadataDir {
+			return errNotEmpty
+		}
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	deleteResp, err := client.DeleteStorageSpace(fs.authCtx, &provider.DeleteStorageSpaceRequest{
+		Id: spc.GetId(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("disable storage space", deleteResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("space", spc.GetId().GetOpaqueId()).
+			Str("code", deleteResp.GetStatus().GetCode().String()).
+			Msg("Could not disable project space")
+		return err
+	}
+
+	return nil
+}
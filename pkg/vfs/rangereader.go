@@ -0,0 +1,410 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+const (
+	// readBlockSize is the granularity in which file content is fetched from the data gateway
+	readBlockSize = 1 << 20
+	// readCacheBlocks is the number of blocks kept per handle, so pipelined reads arriving
+	// slightly out of order are served without a new request
+	readCacheBlocks = 4
+	// sequentialReads is the number of consecutive reads after which a client is considered
+	// to read the file sequentially, which starts the read-ahead
+	sequentialReads = 2
+)
+
+// fetched is the ready channel of blocks which have been fetched synchronously
+var fetched = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// readBlock is an aligned, cached chunk of a file
+type readBlock struct {
+	off  int64
+	data []byte
+	// ready is closed once data has been fetched, err is set if that failed
+	ready chan struct{}
+	err   error
+}
+
+func (blk *readBlock) done() bool {
+	select {
+	case <-blk.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// rangeReader serves ReadAt calls from ranged GET requests against the data gateway. Once the
+// client reads sequentially, the following blocks are fetched concurrently ahead of it.
+// Memory use is bounded by (readCacheBlocks + readAhead) * readBlockSize, whatever the file size.
+type rangeReader struct {
+	fs        *root
+	ref       *provider.Reference
+	size      int64
+	readAhead int
+
+	// ctx is cancelled on close to abort the fetches in flight
+	ctx     context.Context
+	cancel  context.CancelFunc
+	fetches sync.WaitGroup
+
+	mu       sync.Mutex
+	endpoint *transferEndpoint
+	// blocks holds the cached and the pending blocks, least recently used first
+	blocks []*readBlock
+	// body is the currently open response stream positioned at bodyOff
+	body    io.ReadCloser
+	bodyOff int64
+	// next is the offset following the current run of sequential reads, seq the length of the run
+	next int64
+	seq  int
+}
+
+func newRangeReader(fs *root, ref *provider.Reference, size int64) *rangeReader {
+	ctx, cancel := context.WithCancel(fs.authCtx)
+
+	return &rangeReader{
+		fs:        fs,
+		ref:       ref,
+		size:      size,
+		readAhead: fs.downloads.ReadAhead,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// ReadAt implements io.ReaderAt
+func (r *rangeReader) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset not allowed")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := off
+	for n < len(b) && off < r.size {
+		blk, err := r.block(off - off%readBlockSize)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(b[n:], blk.data[off-blk.off:])
+		n += c
+		off += int64(c)
+	}
+
+	if r.sequential(start, off) {
+		r.prefetch(off)
+	}
+
+	if off >= r.size {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Close aborts the fetches in flight and releases the open stream and the cached blocks
+func (r *rangeReader) Close() error {
+	r.cancel()
+
+	r.mu.Lock()
+	r.blocks = nil
+	err := r.closeBody()
+	r.mu.Unlock()
+
+	r.fetches.Wait()
+	return err
+}
+
+// block returns the cached block starting at off, waiting for it if it is being fetched
+// ahead, or fetching it if necessary
+func (r *rangeReader) block(off int64) (*readBlock, error) {
+	for {
+		i, blk := r.cached(off)
+		if blk == nil {
+			break
+		}
+
+		if !blk.done() {
+			r.mu.Unlock()
+			<-blk.ready
+			r.mu.Lock()
+			// the block may have been evicted meanwhile, so look it up again
+			continue
+		}
+
+		if blk.err != nil {
+			// a failed read-ahead, fetch the block again below
+			r.blocks = append(r.blocks[:i], r.blocks[i+1:]...)
+			break
+		}
+
+		// move to the most recently used position
+		copy(r.blocks[i:], r.blocks[i+1:])
+		r.blocks[len(r.blocks)-1] = blk
+		return blk, nil
+	}
+
+	buf, ok := r.alloc(off)
+	if !ok {
+		// all blocks are being fetched ahead, so go without caching this one
+		buf = make([]byte, r.blockLength(off))
+	}
+
+	if err := r.fill(buf, off); err != nil {
+		return nil, err
+	}
+
+	blk := &readBlock{off: off, data: buf, ready: fetched}
+	if ok {
+		r.blocks = append(r.blocks, blk)
+	}
+	return blk, nil
+}
+
+// cached returns the block starting at off and its position, or nil if it is neither cached nor pending
+func (r *rangeReader) cached(off int64) (int, *readBlock) {
+	for i, blk := range r.blocks {
+		if blk.off == off {
+			return i, blk
+		}
+	}
+
+	return -1, nil
+}
+
+// alloc returns a buffer for the block starting at off, recycling the least recently used
+// fetched block once the cache is full. It fails if only pending blocks are left to recycle.
+func (r *rangeReader) alloc(off int64) ([]byte, bool) {
+	length := r.blockLength(off)
+
+	if len(r.blocks) < readCacheBlocks+r.readAhead {
+		return make([]byte, length, readBlockSize), true
+	}
+
+	for i, blk := range r.blocks {
+		if !blk.done() {
+			continue
+		}
+
+		r.blocks = append(r.blocks[:i], r.blocks[i+1:]...)
+		if blk.err != nil || cap(blk.data) < int(length) {
+			return make([]byte, length, readBlockSize), true
+		}
+		return blk.data[:length], true
+	}
+
+	return nil, false
+}
+
+func (r *rangeReader) blockLength(off int64) int64 {
+	return min(int64(readBlockSize), r.size-off)
+}
+
+// sequential records a read of [off, end) and reports whether the client reads sequentially.
+// Pipelining clients have several reads in flight which may arrive slightly out of order,
+// so reads near the end of the current run still count as sequential.
+func (r *rangeReader) sequential(off, end int64) bool {
+	if off+readBlockSize >= r.next && off <= r.next+readBlockSize {
+		r.seq++
+		r.next = max(r.next, end)
+	} else {
+		r.seq = 1
+		r.next = end
+	}
+
+	return r.readAhead > 0 && r.seq >= sequentialReads
+}
+
+// prefetch starts fetching the blocks following off, keeping at most readAhead fetches in flight
+func (r *rangeReader) prefetch(off int64) {
+	pending := 0
+	for _, blk := range r.blocks {
+		if !blk.done() {
+			pending++
+		}
+	}
+
+	first := off - off%readBlockSize
+	for i := 0; i < r.readAhead && pending < r.readAhead; i++ {
+		blkOff := first + int64(i)*readBlockSize
+		if blkOff >= r.size {
+			break
+		}
+
+		if _, blk := r.cached(blkOff); blk != nil {
+			continue
+		}
+
+		if r.endpoint == nil {
+			ep, err := r.fs.initiateDownload(r.ref)
+			if err != nil {
+				return
+			}
+			r.endpoint = &ep
+		}
+
+		buf, ok := r.alloc(blkOff)
+		if !ok {
+			return
+		}
+
+		blk := &readBlock{off: blkOff, data: buf, ready: make(chan struct{})}
+		r.blocks = append(r.blocks, blk)
+		pending++
+
+		r.fetches.Add(1)
+		go r.fetch(blk, *r.endpoint)
+	}
+
+	// the blocks ahead are served by the read-ahead now, so the stream is no longer needed
+	if pending > 0 {
+		_ = r.closeBody()
+	}
+}
+
+// fetch fetches a single block ahead of the client. Errors are kept in the block,
+// so that the client's read retries it synchronously.
+func (r *rangeReader) fetch(blk *readBlock, ep transferEndpoint) {
+	defer r.fetches.Done()
+	defer close(blk.ready)
+
+	httpReq, err := r.fs.newTransferRequest(http.MethodGet, ep, nil)
+	if err != nil {
+		blk.err = err
+		return
+	}
+	httpReq = httpReq.WithContext(r.ctx)
+
+	end := blk.off + int64(len(blk.data)) - 1
+	httpReq.Header.Set("Range", "bytes="+strconv.FormatInt(blk.off, 10)+"-"+strconv.FormatInt(end, 10))
+
+	resp, err := r.fs.httpClient.Do(httpReq)
+	if err != nil {
+		blk.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		blk.err = httpError("read-ahead", resp.StatusCode)
+		return
+	}
+
+	if _, err := io.ReadFull(resp.Body, blk.data); err != nil {
+		blk.err = fmt.Errorf("read-ahead failed at offset %d: %w", blk.off, err)
+	}
+}
+
+// fill reads len(buf) bytes starting at off from the data gateway. The open stream
+// is reused when it is positioned at, or shortly before, the requested offset.
+func (r *rangeReader) fill(buf []byte, off int64) error {
+	if r.body != nil && off >= r.bodyOff && off-r.bodyOff <= readBlockSize {
+		if _, err := io.CopyN(io.Discard, r.body, off-r.bodyOff); err == nil {
+			r.bodyOff = off
+		} else {
+			_ = r.closeBody()
+		}
+	} else {
+		_ = r.closeBody()
+	}
+
+	if r.body == nil {
+		if err := r.open(off); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(r.body, buf)
+	r.bodyOff += int64(n)
+	if err != nil {
+		_ = r.closeBody()
+		return fmt.Errorf("download failed at offset %d: %w", off+int64(n), err)
+	}
+
+	return nil
+}
+
+// open starts a ranged GET from off until the end of the file
+func (r *rangeReader) open(off int64) error {
+	resp, err := r.get(off)
+	if err != nil {
+		return err
+	}
+
+	// the transfer token may have expired, so retry once with a new one
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		r.endpoint = nil
+		if resp, err = r.get(off); err != nil {
+			return err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range header, skip to the requested offset
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return httpError("download", resp.StatusCode)
+	}
+
+	r.body = resp.Body
+	r.bodyOff = off
+
+	r.fs.log.Debug().
+		Str("path", r.ref.GetPath()).
+		Int64("offset", off).
+		Msg("Opened ranged download")
+
+	return nil
+}
+
+func (r *rangeReader) get(off int64) (*http.Response, error) {
+	if r.endpoint == nil {
+		ep, err := r.fs.initiateDownload(r.ref)
+		if err != nil {
+			return nil, err
+		}
+		r.endpoint = &ep
+	}
+
+	httpReq, err := r.fs.newTransferRequest(http.MethodGet, *r.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(r.ctx)
+	httpReq.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-")
+
+	return r.fs.httpClient.Do(httpReq)
+}
+
+func (r *rangeReader) closeBody() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,207 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/rs/zerolog"
+)
+
+// partialUpload describes the content of an interrupted upload which has been kept for resuming
+type partialUpload struct {
+	User  string    `json:"user"`
+	Space string    `json:"space"`
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Etag  string    `json:"etag"` // etag of the target file at the time the upload was interrupted
+	Saved time.Time `json:"saved"`
+}
+
+// resumeStore keeps the content of interrupted uploads on disk, keyed by user and path, so that
+// clients can resume them in a later session (e.g. "reput" in OpenSSH). While a partial upload is
+// kept, the target reports the size received so far, which is where clients continue writing.
+type resumeStore struct {
+	dir    string
+	expiry time.Duration
+	log    zerolog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*partialUpload
+}
+
+// newResumeStore loads the partial uploads kept in the resume directory and drops expired ones
+func newResumeStore(cfg config.Uploads, logger zerolog.Logger) (*resumeStore, error) {
+	if err := os.MkdirAll(cfg.ResumeDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload resume dir: %w", err)
+	}
+
+	s := &resumeStore{
+		dir:     cfg.ResumeDir,
+		expiry:  cfg.ResumeExpiry,
+		log:     logger,
+		entries: map[string]*partialUpload{},
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, metaFile := range metaFiles {
+		key := strings.TrimSuffix(filepath.Base(metaFile), ".json")
+
+		raw, err := os.ReadFile(metaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &partialUpload{}
+		if err := json.Unmarshal(raw, p); err != nil || s.expired(p) {
+			s.remove(key)
+			continue
+		}
+
+		if fi, err := os.Stat(s.dataPath(key)); err != nil || fi.Size() != p.Size {
+			s.remove(key)
+			continue
+		}
+
+		s.entries[key] = p
+	}
+
+	// data files without metadata are left over from interrupted saves
+	dataFiles, err := filepath.Glob(filepath.Join(s.dir, "*.part"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dataFile := range dataFiles {
+		if _, ok := s.entries[strings.TrimSuffix(filepath.Base(dataFile), ".part")]; !ok {
+			_ = os.Remove(dataFile)
+		}
+	}
+
+	return s, nil
+}
+
+// resumeKey derives the store key for a file of a user
+func resumeKey(user string, ref *provider.Reference) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + ref.GetResourceId().GetStorageId() + "$" + ref.GetResourceId().GetSpaceId() + "\x00" + filepath.Clean(ref.GetPath())))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the partial upload kept for key if the target still has the given etag
+func (s *resumeStore) get(key, etag string) *partialUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if s.expired(p) || p.Etag != etag {
+		// the upload was abandoned, or the target has been changed by someone else meanwhile
+		delete(s.entries, key)
+		s.remove(key)
+		return nil
+	}
+
+	return p
+}
+
+// claim removes the partial upload for key from the store and returns the path of its content,
+// which the caller takes ownership of.
+func (s *resumeStore) claim(key, etag string) (*partialUpload, string) {
+	p := s.get(key, etag)
+	if p == nil {
+		return nil, ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	_ = os.Remove(s.metaPath(key))
+	return p, s.dataPath(key)
+}
+
+// save keeps the first p.Size bytes of buffer for key
+func (s *resumeStore) save(key string, p *partialUpload, buffer *writeBuffer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := buffer.persist(s.dataPath(key), p.Size); err != nil {
+		s.remove(key)
+		return err
+	}
+
+	raw, err := json.Marshal(p)
+	if err == nil {
+		err = os.WriteFile(s.metaPath(key), raw, 0600)
+	}
+	if err != nil {
+		s.remove(key)
+		return err
+	}
+
+	s.entries[key] = p
+
+	s.log.Debug().
+		Str("path", p.Path).
+		Int64("size", p.Size).
+		Msg("Kept interrupted upload for resuming")
+
+	return nil
+}
+
+// discard drops the partial upload for key, if any
+func (s *resumeStore) discard(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.remove(key)
+	}
+}
+
+func (s *resumeStore) expired(p *partialUpload) bool {
+	return s.expiry > 0 && time.Since(p.Saved) > s.expiry
+}
+
+func (s *resumeStore) remove(key string) {
+	_ = os.Remove(s.metaPath(key))
+	_ = os.Remove(s.dataPath(key))
+}
+
+func (s *resumeStore) metaPath(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+func (s *resumeStore) dataPath(key string) string {
+	return filepath.Join(s.dir, key+".part")
+}
+
+// resumedSize returns the size to report for a file. While an interrupted upload of the file is kept,
+// this is the size received so far, so that clients resume writing from there.
+func (fs *root) resumedSize(ref *provider.Reference, info *provider.ResourceInfo) int64 {
+	size := int64(info.GetSize())
+	if fs.resumes == nil || info.GetType() != provider.ResourceType_RESOURCE_TYPE_FILE {
+		return size
+	}
+
+	if p := fs.resumes.get(resumeKey(fs.userID, ref), info.GetEtag()); p != nil && p.Size > size {
+		return p.Size
+	}
+
+	return size
+}
@@ -0,0 +1,572 @@
+package vfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/pkg/sftp"
+)
+
+// maxSCPLine bounds the control lines read from the client
+const maxSCPLine = 4096
+
+// scpError is an error reported by the other side of an scp session. Fatal errors end the session,
+// others only skip the file they refer to.
+type scpError struct {
+	msg   string
+	fatal bool
+}
+
+func (e *scpError) Error() string {
+	return e.msg
+}
+
+// scpSession runs the server side of the scp protocol, as started by "scp -t" to receive files
+// and by "scp -f" to send files
+type scpSession struct {
+	fs  *root
+	in  *bufio.Reader
+	out io.Writer
+
+	recursive     bool
+	preserveTimes bool
+	targetDir     bool
+
+	// failed is set once an error has been reported to the client, it fails the exit status
+	failed bool
+}
+
+// scp runs the scp command with the given arguments on the file system. The files are transferred
+// through the same handles as sftp uploads and downloads, no scp binary is involved.
+func (fs *root) scp(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	s := &scpSession{fs: fs, in: bufio.NewReader(stdin), out: stdout}
+
+	var sink, source bool
+	var paths []string
+	options := true
+	for _, arg := range args {
+		if !options || arg == "-" || !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+		if arg == "--" {
+			options = false
+			continue
+		}
+
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				s.recursive = true
+			case 'p':
+				s.preserveTimes = true
+			case 'd':
+				s.targetDir = true
+			case 'v', 'q':
+			default:
+				fmt.Fprintf(stderr, "scp: option -%c is not supported\n", flag)
+				return 1
+			}
+		}
+	}
+
+	var err error
+	switch {
+	case sink == source:
+		fmt.Fprintln(stderr, "scp: exactly one of -t and -f is required, scp can only be run by an scp client")
+		return 1
+	case sink && len(paths) != 1:
+		fmt.Fprintln(stderr, "scp: -t takes exactly one target")
+		return 1
+	case sink:
+		var target string
+		if target, err = fs.expandPath(paths[0]); err == nil {
+			err = s.sink(target)
+		}
+	default:
+		err = s.source(paths)
+	}
+
+	if err != nil {
+		fs.log.Debug().Err(err).Msg("scp failed")
+
+		var scpErr *scpError
+		if !errors.As(err, &scpErr) {
+			// errors of the client have been shown to the user on its side already
+			s.fatal(err)
+		}
+		return 1
+	}
+
+	if s.failed {
+		return 1
+	}
+	return 0
+}
+
+// sink receives files into target. If target is an existing directory, files and directories
+// are created in it, otherwise the single file or directory sent is stored as target.
+func (s *scpSession) sink(target string) error {
+	info, err := s.statPath(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	isDir := info != nil && info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+	if s.targetDir && !isDir {
+		return fmt.Errorf("%s: Not a directory", target)
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	type dirEntry struct {
+		path  string
+		mtime time.Time
+	}
+
+	var dirs []dirEntry
+	var mtime time.Time
+	for {
+		typ, err := s.in.ReadByte()
+		if errors.Is(err, io.EOF) && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+
+		cur, curIsDir := target, isDir
+		if len(dirs) > 0 {
+			cur, curIsDir = dirs[len(dirs)-1].path, true
+		}
+
+		switch typ {
+		case 1, 2:
+			// the client could not send a file, it has shown the error already
+			s.fs.log.Debug().Str("error", line).Msg("scp client reported an error")
+			if typ == 2 {
+				return &scpError{msg: line, fatal: true}
+			}
+		case 'T':
+			if mtime, err = parseSCPTimes(line); err != nil {
+				return err
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			size, name, err := parseSCPEntry(line)
+			if err != nil {
+				return err
+			}
+
+			dest := cur
+			if curIsDir {
+				dest = path.Join(cur, name)
+			}
+
+			if typ == 'C' {
+				err = s.receiveFile(dest, size, mtime)
+				mtime = time.Time{}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !s.recursive {
+				return errors.New("received a directory without -r")
+			}
+
+			if err := s.makeDir(dest); err != nil {
+				s.warn(dest, err)
+				mtime = time.Time{}
+				continue
+			}
+
+			dirs = append(dirs, dirEntry{path: dest, mtime: mtime})
+			mtime = time.Time{}
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unexpected end of directory")
+			}
+
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if s.preserveTimes && !dir.mtime.IsZero() {
+				if err := s.setMtime(dir.path, dir.mtime); err != nil {
+					s.warn(dir.path, err)
+					continue
+				}
+			}
+
+			if err := s.ack(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message type %q", typ)
+		}
+	}
+}
+
+// receiveFile stores size bytes sent by the client at dest. Failures to store the file are reported
+// to the client, which goes on with the next file.
+func (s *scpSession) receiveFile(dest string, size int64, mtime time.Time) error {
+	h, err := s.fs.openFile(dest, sftp.FileOpenFlags{Write: true, Creat: true, Trunc: true})
+	if err != nil {
+		// the client does not send the content of files which are refused
+		s.warn(dest, err)
+		return nil
+	}
+
+	if err := s.ack(); err != nil {
+		h.TransferError(err)
+		_ = h.Close()
+		return err
+	}
+
+	content := &io.LimitedReader{R: s.in, N: size}
+	_, copyErr := io.Copy(io.NewOffsetWriter(h, 0), content)
+	if copyErr != nil {
+		// the content has to be read anyway, if that fails as well the connection is gone
+		_, _ = io.Copy(io.Discard, content)
+	}
+	if content.N > 0 {
+		h.TransferError(io.ErrUnexpectedEOF)
+		_ = h.Close()
+		return io.ErrUnexpectedEOF
+	}
+
+	if err := s.readAck(); err != nil {
+		h.TransferError(err)
+		_ = h.Close()
+
+		var scpErr *scpError
+		if errors.As(err, &scpErr) && !scpErr.fatal {
+			return nil
+		}
+		return err
+	}
+
+	if copyErr != nil {
+		h.TransferError(copyErr)
+		_ = h.Close()
+		s.warn(dest, copyErr)
+		return nil
+	}
+
+	if s.preserveTimes && !mtime.IsZero() {
+		_ = h.setstat(sftp.FileAttrFlags{Acmodtime: true}, &sftp.FileStat{Mtime: uint32(mtime.Unix())})
+	}
+
+	if err := h.Close(); err != nil {
+		s.warn(dest, err)
+		return nil
+	}
+
+	return s.ack()
+}
+
+// makeDir creates the directory at p, unless it exists already
+func (s *scpSession) makeDir(p string) error {
+	info, err := s.statPath(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s.fs.mkdir(p)
+	case err != nil:
+		return err
+	case info.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER:
+		return syscall.ENOTDIR
+	default:
+		return nil
+	}
+}
+
+// setMtime sets the modification time of the resource at p
+func (s *scpSession) setMtime(p string, mtime time.Time) error {
+	ref, err := s.fs.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	return s.fs.setMtime(ref, mtime)
+}
+
+// source sends the files and, with -r, directory trees at the given paths to the client
+func (s *scpSession) source(paths []string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	for _, name := range paths {
+		p, err := s.fs.expandPath(name)
+		if err != nil {
+			s.warn(name, err)
+			continue
+		}
+
+		ref, err := s.fs.resolve(p)
+		if err != nil {
+			s.warn(p, err)
+			continue
+		}
+
+		info, err := s.fs.statRef(ref)
+		if err == nil && info == nil {
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			s.warn(p, err)
+			continue
+		}
+
+		if err := s.send(p, ref, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send sends a file or a directory tree. Only errors which end the session are returned,
+// others are reported to the client.
+func (s *scpSession) send(p string, ref *provider.Reference, info *provider.ResourceInfo) error {
+	isDir := info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+	if isDir && !s.recursive {
+		s.warn(p, errors.New("not a regular file"))
+		return nil
+	}
+
+	if s.preserveTimes {
+		mtime := info.GetMtime().GetSeconds()
+		if err := s.sendLine(fmt.Sprintf("T%d 0 %d 0", mtime, mtime)); err != nil {
+			return s.skip(err)
+		}
+	}
+
+	if !isDir {
+		return s.sendFile(p, ref, info)
+	}
+
+	if err := s.sendLine(fmt.Sprintf("D%04o 0 %s", fileMode(info).Perm(), path.Base(p))); err != nil {
+		return s.skip(err)
+	}
+
+	children, err := s.fs.listRef(ref)
+	if err != nil {
+		// the directory has been announced, it is closed empty
+		s.warn(p, err)
+		children = nil
+	}
+
+	for _, child := range children {
+		if isStagingName(child.GetName()) {
+			continue
+		}
+
+		childRef := &provider.Reference{ResourceId: ref.GetResourceId(), Path: path.Join(ref.GetPath(), child.GetName())}
+		if err := s.send(path.Join(p, child.GetName()), childRef, child); err != nil {
+			return err
+		}
+	}
+
+	return s.skip(s.sendLine("E"))
+}
+
+// sendFile sends the content of a file. Once the size has been announced the client expects that many bytes,
+// so if the download fails the rest is filled with zeros and the error is reported in place of the final ack.
+func (s *scpSession) sendFile(p string, ref *provider.Reference, info *provider.ResourceInfo) error {
+	size := int64(info.GetSize())
+	if err := s.sendLine(fmt.Sprintf("C%04o %d %s", fileMode(info).Perm(), size, path.Base(p))); err != nil {
+		return s.skip(err)
+	}
+
+	reader := newRangeReader(s.fs, ref, size)
+	defer reader.Close()
+
+	buf := make([]byte, 32*1024)
+	var readErr error
+	for off := int64(0); off < size; {
+		n := int(min(int64(len(buf)), size-off))
+		if readErr == nil {
+			m, err := reader.ReadAt(buf[:n], off)
+			if m < n {
+				readErr = err
+				if readErr == nil || errors.Is(readErr, io.EOF) {
+					readErr = io.ErrUnexpectedEOF
+				}
+				clear(buf[m:n])
+			}
+		} else {
+			clear(buf[:n])
+		}
+
+		if _, err := s.out.Write(buf[:n]); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+
+	if readErr != nil {
+		s.warn(p, readErr)
+	} else if _, err := s.out.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	return s.skip(s.readAck())
+}
+
+// sendLine sends a control line and waits for the client to acknowledge it
+func (s *scpSession) sendLine(line string) error {
+	if _, err := io.WriteString(s.out, line+"\n"); err != nil {
+		return err
+	}
+
+	return s.readAck()
+}
+
+// skip drops errors of the client which only refer to the current file, it has shown them already
+func (s *scpSession) skip(err error) error {
+	var scpErr *scpError
+	if errors.As(err, &scpErr) && !scpErr.fatal {
+		return nil
+	}
+
+	return err
+}
+
+// ack tells the client that the last message has been handled
+func (s *scpSession) ack() error {
+	_, err := s.out.Write([]byte{0})
+	return err
+}
+
+// readAck waits for the client to acknowledge the last message
+func (s *scpSession) readAck() error {
+	typ, err := s.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if typ == 0 {
+		return nil
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	return &scpError{msg: line, fatal: typ != 1}
+}
+
+// readLine reads the rest of a control line
+func (s *scpSession) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := s.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) == maxSCPLine {
+			return "", errors.New("control line too long")
+		}
+		line = append(line, b)
+	}
+}
+
+// warn reports an error about p to the client, which goes on with the next file
+func (s *scpSession) warn(p string, err error) {
+	s.failed = true
+	s.fs.log.Debug().Err(err).Str("path", p).Msg("scp transfer failed")
+	_, _ = fmt.Fprintf(s.out, "\x01scp: %s: %s\n", p, execErrorText(err))
+}
+
+// fatal reports an error to the client which ends the session
+func (s *scpSession) fatal(err error) {
+	s.failed = true
+	_, _ = fmt.Fprintf(s.out, "\x02scp: %s\n", err)
+}
+
+// statPath returns the resource info at p, or os.ErrNotExist
+func (s *scpSession) statPath(p string) (*provider.ResourceInfo, error) {
+	ref, err := s.fs.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.fs.statRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, os.ErrNotExist
+	}
+
+	return info, nil
+}
+
+// parseSCPTimes parses the modification time of a "T<mtime> 0 <atime> 0" line
+func parseSCPTimes(line string) (time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return time.Time{}, fmt.Errorf("invalid times %q", line)
+	}
+
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid times %q", line)
+	}
+
+	return time.Unix(sec, 0), nil
+}
+
+// parseSCPEntry parses the size and the name of a "C<mode> <size> <name>" or "D<mode> 0 <name>" line.
+// The mode is ignored, as the storage does not keep one.
+func parseSCPEntry(line string) (int64, string, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, "", fmt.Errorf("invalid entry %q", line)
+	}
+
+	if _, err := strconv.ParseUint(fields[0], 8, 32); err != nil {
+		return 0, "", fmt.Errorf("invalid mode %q", fields[0])
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, "", fmt.Errorf("invalid size %q", fields[1])
+	}
+
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, "", fmt.Errorf("unexpected filename %q", name)
+	}
+
+	return size, name, nil
+}
@@ -0,0 +1,174 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/pkg/sftp"
+)
+
+// setstat handles Setstat and Fsetstat requests. Size and modification time are stored, the access time is
+// ignored since spaces do not keep it. Permission and ownership changes are ignored or rejected according
+// to the configured policy.
+func (fs *root) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	fs.log.Debug().
+		Str("path", r.Filepath).
+		Bool("size", flags.Size).
+		Bool("times", flags.Acmodtime).
+		Bool("permissions", flags.Permissions).
+		Bool("ownership", flags.UidGid).
+		Msg("Setstat called")
+
+	if flags.Permissions && fs.setstatPolicy.Permissions == config.SetstatReject {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if flags.UidGid && fs.setstatPolicy.Ownership == config.SetstatReject {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	if !flags.Size && !flags.Acmodtime {
+		return nil
+	}
+
+	// Fsetstat requests only carry the path of the handle, the change has to reach its buffered content
+	if h := fs.writer(r.Filepath); h != nil {
+		return h.setstat(flags, attrs)
+	}
+
+	spc, relPath, err := fs.findSpace(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	if spc == nil {
+		return os.ErrNotExist
+	}
+
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
+	if err != nil {
+		fs.log.Debug().Err(err).Msg("makeStorageSpaceReference error in setstat")
+		return err
+	}
+
+	info, err := fs.statRef(&ref)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return os.ErrNotExist
+	}
+	if !mayWrite(info) {
+		return newStatusError("setstat", syscall.EACCES)
+	}
+
+	if flags.Size {
+		if info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			return syscall.EISDIR
+		}
+		// avoid uploading unchanged content, clients often send the size along with the times
+		if attrs.Size != info.GetSize() {
+			if err := fs.truncate(&ref, info, int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if flags.Acmodtime {
+		return fs.setMtime(&ref, attrs.ModTime())
+	}
+
+	return nil
+}
+
+// truncate changes the size of the stored file at ref. Only the content which is kept is downloaded,
+// nothing at all when the file is emptied, and a file which grows is padded with zeros.
+func (fs *root) truncate(ref *provider.Reference, info *provider.ResourceInfo, size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+
+	buffer := fs.spool.newBuffer()
+	defer func() { _ = buffer.Close() }()
+
+	if keep := min(size, int64(info.GetSize())); keep > 0 {
+		// the reader ends where the kept content does, so that nothing beyond it is fetched ahead
+		reader := newRangeReader(fs, ref, keep)
+		defer reader.Close()
+
+		if _, err := io.Copy(io.NewOffsetWriter(buffer, 0), io.NewSectionReader(reader, 0, keep)); err != nil {
+			return err
+		}
+	}
+
+	if err := buffer.Truncate(size); err != nil {
+		return err
+	}
+
+	// the etag makes the upload fail if the file has been changed meanwhile
+	if fs.staging != nil {
+		_, err := fs.publish(ref, buffer, size, info.GetEtag())
+		return err
+	}
+
+	_, err := fs.upload(ref, buffer, size, info.GetEtag())
+	return err
+}
+
+// setMtime sets the modification time of the referenced resource
+func (fs *root) setMtime(ref *provider.Reference, mtime time.Time) error {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.SetArbitraryMetadata(fs.authCtx, &provider.SetArbitraryMetadataRequest{
+		Ref: ref,
+		ArbitraryMetadata: &provider.ArbitraryMetadata{
+			Metadata: map[string]string{"mtime": strconv.FormatInt(mtime.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return cs3Error("set mtime", resp.GetStatus())
+}
+
+// addWriter registers a handle opened for writing
+func (fs *root) addWriter(h *sftpFileHandler) {
+	if !h.writable() {
+		return
+	}
+
+	fs.writersMu.Lock()
+	defer fs.writersMu.Unlock()
+
+	fs.writers[h.filepath] = h
+}
+
+// removeWriter unregisters a handle, unless another handle for the same path has been opened since
+func (fs *root) removeWriter(h *sftpFileHandler) {
+	fs.writersMu.Lock()
+	defer fs.writersMu.Unlock()
+
+	if fs.writers[h.filepath] == h {
+		delete(fs.writers, h.filepath)
+	}
+}
+
+// writer returns the handle open for writing the file at path, or nil
+func (fs *root) writer(path string) *sftpFileHandler {
+	fs.writersMu.Lock()
+	defer fs.writersMu.Unlock()
+
+	return fs.writers[path]
+}
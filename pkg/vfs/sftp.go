@@ -3,34 +3,188 @@ package vfs
 import (
 	"context"
 	"errors"
-	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	"fmt"
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	"github.com/IljaN/opencloud-sftp/pkg/sftpext"
 	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
 	storageProvider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	ctxpkg "github.com/opencloud-eu/reva/v2/pkg/ctx"
 	"github.com/opencloud-eu/reva/v2/pkg/rgrpc/todo/pool"
 	"github.com/pkg/sftp"
 	"github.com/rs/zerolog"
 	"io"
+	"net/http"
 
 	iofs "io/fs"
 	"os"
+	"path"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func OpenCloudHandler(authCtx context.Context, sel *pool.Selector[gateway.GatewayAPIClient], logger zerolog.Logger) sftp.Handlers {
-	root := &root{
-		authCtx:    authCtx,
+// OpenCloudFS holds the state shared by all sftp sessions
+type OpenCloudFS struct {
+	cfg        *config.Config
+	gwSelector *pool.Selector[gateway.GatewayAPIClient]
+	log        zerolog.Logger
+	httpClient *http.Client
+	spool      *spool
+	resumes    *resumeStore
+	staging    *stagingJournal
+	ids        *idMap
+}
+
+func NewOpenCloudFS(cfg *config.Config, sel *pool.Selector[gateway.GatewayAPIClient], logger zerolog.Logger) (*OpenCloudFS, error) {
+	spool, err := newSpool(cfg.Uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	var resumes *resumeStore
+	if cfg.Uploads.Resumable {
+		if resumes, err = newResumeStore(cfg.Uploads, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	var staging *stagingJournal
+	if cfg.Uploads.Atomic {
+		if staging, err = newStagingJournal(cfg.Uploads); err != nil {
+			return nil, err
+		}
+
+		janitor := &stagingJanitor{
+			journal:    staging,
+			gwSelector: sel,
+			apiKey:     cfg.MachineAuthAPIKey,
+			interval:   cfg.Uploads.StagingCleanupInterval,
+			log:        logger,
+		}
+		go janitor.run()
+	}
+
+	return &OpenCloudFS{
+		cfg:        cfg,
 		gwSelector: sel,
 		log:        logger,
+		httpClient: newDataGatewayClient(),
+		spool:      spool,
+		resumes:    resumes,
+		staging:    staging,
+		ids:        newIDMap(),
+	}, nil
+}
+
+// Session holds what the request server of an sftp session needs
+type Session struct {
+	Handlers sftp.Handlers
+	// Extensions are the extended requests of the session which pkg/sftp does not handle
+	Extensions []sftpext.Extension
+	// Home is the directory the session starts in, relative paths are resolved against it
+	Home string
+}
+
+// Handler returns the sftp session of the user authenticated in authCtx
+func (ocfs *OpenCloudFS) Handler(authCtx context.Context, logger zerolog.Logger) (*Session, error) {
+	root, err := ocfs.newRoot(authCtx, logger)
+	if err != nil {
+		return nil, err
 	}
 
-	root.log.Debug().Msg("Initializing sftp vfs")
-	return sftp.Handlers{root, root, root, root}
+	root.log.Debug().Str("home", root.home).Msg("Initializing sftp vfs")
+	return &Session{
+		Handlers:   sftp.Handlers{FileGet: root, FilePut: root, FileCmd: root, FileList: root},
+		Extensions: root.extensions(),
+		Home:       root.home,
+	}, nil
+}
+
+// extensions returns the extended requests of the session which pkg/sftp does not handle
+func (fs *root) extensions() []sftpext.Extension {
+	return []sftpext.Extension{
+		{Name: "copy-data", Data: "1", Handle: fs.handleCopyData},
+		{Name: "copy-file", Data: "1", Handle: fs.handleCopyFile},
+		{Name: "check-file-name", Data: "1", Handle: fs.handleCheckFileName},
+		{Name: "check-file-handle", Data: "1", Handle: fs.handleCheckFileHandle},
+		{Name: "expand-path@openssh.com", Data: "1", Path: fs.handleExpandPath},
+		{Name: "home-directory", Data: "1", Path: fs.handleHomeDirectory},
+		{Name: "users-groups-by-id@openssh.com", Data: "1", Handle: fs.handleUsersGroupsByID},
+	}
+}
+
+// newRoot returns the file system of the user authenticated in authCtx. It fails if the user is confined
+// to a chroot directory which is not available.
+func (ocfs *OpenCloudFS) newRoot(authCtx context.Context, logger zerolog.Logger) (*root, error) {
+	user, _ := ctxpkg.ContextGetUser(authCtx)
+
+	fs := &root{
+		authCtx:       authCtx,
+		userID:        user.GetId().GetOpaqueId(),
+		username:      user.GetUsername(),
+		gwSelector:    ocfs.gwSelector,
+		log:           logger,
+		httpClient:    ocfs.httpClient,
+		spool:         ocfs.spool,
+		uploads:       ocfs.cfg.Uploads,
+		downloads:     ocfs.cfg.Downloads,
+		setstatPolicy: ocfs.cfg.Setstat,
+		layout:        ocfs.cfg.Layout,
+		spaces:        ocfs.cfg.Spaces,
+		resumes:       ocfs.resumes,
+		staging:       ocfs.staging,
+		ids:           ocfs.ids,
+		writers:       make(map[string]*sftpFileHandler),
+	}
+
+	if err := fs.setChroot(ocfs.cfg.Chroot, user); err != nil {
+		return nil, err
+	}
+
+	home, err := fs.homeDir()
+	if err != nil {
+		// the session is still usable, it starts in the root
+		fs.log.Error().Err(err).Msg("Could not find the home directory")
+		home = "/"
+	}
+	fs.home = home
+
+	return fs, nil
 }
 
 type root struct {
-	authCtx    context.Context
+	authCtx  context.Context
+	userID   string
+	username string
+	// home is the path of the personal space, relative paths are resolved against it
+	home       string
 	gwSelector *pool.Selector[gateway.GatewayAPIClient]
 	log        zerolog.Logger
+
+	// HTTP client for data gateway operations
+	httpClient *http.Client
+	// spool provides the buffers for uploads
+	spool         *spool
+	uploads       config.Uploads
+	downloads     config.Downloads
+	setstatPolicy config.Setstat
+	layout        config.Layout
+	// chroot confines the session to a single directory, nil if the user sees the layout
+	chroot *config.Chroot
+	// spaces defines which changes to project spaces can be made in the root
+	spaces config.Spaces
+	// resumes keeps interrupted uploads, nil if resuming is disabled
+	resumes *resumeStore
+	// staging records the temporary resources of atomic uploads, nil if uploads are written to the target directly
+	staging *stagingJournal
+	// ids maps the owners of resources to numeric ids and names
+	ids *idMap
+
+	writersMu sync.Mutex
+	// writers holds the handles open for writing by path, so that attribute changes reach their buffered content
+	writers map[string]*sftpFileHandler
 }
 
 func (fs *root) Fileread(r *sftp.Request) (io.ReaderAt, error) {
@@ -40,7 +194,22 @@ func (fs *root) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 		return nil, os.ErrInvalid
 	}
 
-	return fs.OpenFile(r)
+	reader, err := fs.OpenFile(r)
+	var trashErr *trashPathError
+	if errors.As(err, &trashErr) {
+		reader, err := fs.openTrashFile(trashErr.space, trashErr.path)
+		return reader, sftpError(err)
+	}
+	var versionsErr *versionsPathError
+	if errors.As(err, &versionsErr) {
+		_, ref, info, err := fs.fileVersion(versionsErr)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return newRangeReader(fs, ref, int64(info.GetSize())), nil
+	}
+
+	return reader, err
 }
 
 func (fs *root) Filewrite(r *sftp.Request) (io.WriterAt, error) {
@@ -59,85 +228,162 @@ func (fs *root) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
 		Uint32("flags", r.Flags).
 		Msg("OpenFile called")
 
-	storageSpaces, err := fs.listStorageSpaces()
+	h, err := fs.openFile(r.Filepath, r.Pflags())
 	if err != nil {
-		return nil, err
+		// the errors of the virtual directories are still found by Fileread, which opens their files
+		return nil, sftpError(err)
 	}
 
-	spc, relPath, err := spacelookup.FindSpaceForPath(r.Filepath, storageSpaces)
+	return h, nil
+}
+
+// openFile opens the file at the absolute path p with the given flags, creating it if asked to
+func (fs *root) openFile(p string, flags sftp.FileOpenFlags) (*sftpFileHandler, error) {
+	ref, err := fs.resolve(p)
 	if err != nil {
 		return nil, err
 	}
 
-	if spc == nil {
-		return nil, os.ErrNotExist
-	}
+	h := newSftpFileHandler(fs, ref, p, flags)
 
-	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), relPath)
+	info, err := h.statFile()
 	if err != nil {
-		fs.log.Debug().Err(err).Msg("makeStorageSpaceReference error in OpenFile")
 		return nil, err
 	}
 
-	// Create file if it doesn't exist and flags indicate creation
-	flags := r.Pflags()
-	if flags.Write && (flags.Creat || flags.Trunc) {
-		client, err := fs.gwSelector.Next()
-		if err != nil {
+	if info != nil && flags.Read && !mayRead(info) {
+		return nil, newStatusError("open", syscall.EACCES)
+	}
+	if info != nil {
+		// the content written through the handle is only stored if the file has not been changed meanwhile
+		h.etag = info.GetEtag()
+	}
+
+	if !flags.Write && !flags.Append {
+		if info == nil {
+			return nil, os.ErrNotExist
+		}
+		return h, nil
+	}
+
+	switch {
+	case info != nil && flags.Creat && flags.Excl:
+		return nil, os.ErrExist
+	case info == nil && !flags.Creat:
+		return nil, os.ErrNotExist
+	case info != nil && !mayWrite(info):
+		// refused right away, rather than when the content is uploaded on close
+		return nil, newStatusError("open", syscall.EACCES)
+	case info == nil:
+		if err := fs.checkCreate(ref); err != nil {
 			return nil, err
 		}
+		// Atomic uploads create the target when they are published, unless exclusive creation
+		// has to be decided right away
+		if fs.staging == nil || flags.Excl {
+			if err := fs.touch(ref, flags.Excl); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		// Touch the file to ensure it exists
-		_, err = client.TouchFile(fs.authCtx, &storageProvider.TouchFileRequest{
-			Ref: &storageProvider.Reference{ResourceId: ref.GetResourceId(), Path: relPath},
-		})
-		if err != nil {
-			fs.log.Debug().Err(err).Msg("TouchFile error in OpenFile")
-			// Ignore error - file might already exist
+	if flags.Trunc {
+		// The handle starts out empty, the truncated content is stored when the handle is closed
+		if _, err := h.writeBuffer(); err != nil {
+			return nil, err
 		}
 	}
 
-	// Return the file handler that implements WriterAt and ReaderAt
-	return newSftpFileHandler(fs, &ref, r.Filepath, r.Flags), nil
+	fs.addWriter(h)
+	return h, nil
+}
+
+// checkCreate checks that a file can be created at ref, which depends on the permissions of its directory
+func (fs *root) checkCreate(ref *storageProvider.Reference) error {
+	parent, err := fs.statRef(&storageProvider.Reference{ResourceId: ref.GetResourceId(), Path: path.Dir(ref.GetPath())})
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		return os.ErrNotExist
+	}
+	if !mayWrite(parent) {
+		return newStatusError("create", syscall.EACCES)
+	}
+
+	return nil
+}
+
+// touch creates an empty file. If excl is set, it fails if the file exists already.
+func (fs *root) touch(ref *storageProvider.Reference, excl bool) error {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	touchResp, err := client.TouchFile(fs.authCtx, &storageProvider.TouchFileRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return err
+	}
+
+	if touchResp.GetStatus().GetCode() == rpc.Code_CODE_ALREADY_EXISTS && !excl {
+		// the file has been created concurrently
+		return nil
+	}
+
+	return cs3Error("create", touchResp.GetStatus())
 }
 
 func (fs *root) Filecmd(r *sftp.Request) error {
+	return sftpError(fs.filecmd(r))
+}
+
+func (fs *root) filecmd(r *sftp.Request) error {
 	switch r.Method {
 	case "Setstat":
-		return errors.New("setstat not supported")
+		return fs.setstat(r)
 	case "Rename":
 		// SFTP-v2: "It is an error if there already exists a file with the name specified by newpath."
 		// This varies from the POSIX specification, which allows limited replacement of target files.
 		return fs.rename(r.Filepath, r.Target, false)
 	case "Rmdir":
+		if r.Filepath == "/" {
+			// the root is the layout, or the directory of a chroot, neither can be removed
+			return os.ErrPermission
+		}
 		return fs.rmdir(r.Filepath)
 	case "Remove":
 		// IEEE 1003.1 remove explicitly can unlink files and remove empty directories.
 		// We use instead here the semantics of unlink, which is allowed to be restricted against directories.
+		if r.Filepath == "/" {
+			return os.ErrPermission
+		}
 		return fs.remove(r.Filepath)
 	case "Mkdir":
 		return fs.mkdir(r.Filepath)
 	case "Link":
-		return errors.New("hard links are not supported")
+		return fmt.Errorf("hard links are not supported: %w", errors.ErrUnsupported)
 	case "Symlink":
 		// NOTE: r.Filepath is the target, and r.Target is the linkpath.
-		return errors.New("symbolic links are not supported")
+		return fmt.Errorf("symbolic links are not supported: %w", errors.ErrUnsupported)
 	}
 
-	return errors.New("unsupported")
+	return errors.ErrUnsupported
 }
 
 func (fs *root) rename(oldpath, newpath string, allowOverwrite bool) error {
+	if oldpath == "/" || newpath == "/" {
+		return os.ErrPermission
+	}
+
 	return fs.renameFile(oldpath, newpath, allowOverwrite)
 }
 
 func (fs *root) PosixRename(r *sftp.Request) error {
 	// POSIX rename allows overwriting existing files
-	return fs.rename(r.Filepath, r.Target, true)
-}
-
-func (fs *root) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
-	return nil, errors.New("StatVFS not supported")
+	return sftpError(fs.rename(r.Filepath, r.Target, true))
 }
 
 type listerat []os.FileInfo
@@ -161,7 +407,10 @@ type fileInfo struct {
 	mode  iofs.FileMode
 	mtime time.Time
 	isDir bool
-	sys   any
+	// owner is the CS3 user owning the resource, uid and gid are its numeric ids once it has been resolved
+	owner *userpb.UserId
+	uid   uint32
+	gid   uint32
 }
 
 func (f fileInfo) Name() string {
@@ -184,8 +433,29 @@ func (f fileInfo) IsDir() bool {
 	return f.isDir
 }
 
+// Sys returns the attributes of the file as sent to the client, which carry the owner for long listings
 func (f fileInfo) Sys() any {
-	return f.sys
+	mode := uint32(f.mode.Perm()) | syscall.S_IFREG
+	if f.isDir {
+		mode = uint32(f.mode.Perm()) | syscall.S_IFDIR
+	}
+
+	return &sftp.FileStat{
+		Size:  uint64(f.size),
+		Mode:  mode,
+		Mtime: uint32(f.mtime.Unix()),
+		Atime: uint32(f.mtime.Unix()),
+		UID:   f.uid,
+		GID:   f.gid,
+	}
+}
+
+func (f fileInfo) Uid() uint32 {
+	return f.uid
+}
+
+func (f fileInfo) Gid() uint32 {
+	return f.gid
 }
 
 func (fs *root) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
@@ -197,11 +467,39 @@ func (fs *root) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	switch r.Method {
 	case "List":
 		list, err := fs.list(r.Filepath)
-		return listerat(list), err
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		fs.setOwners(list)
+		return listerat(list), nil
 	case "Stat":
-		fi, err := fs.stat(r.Filepath)
-		return listerat{fi}, err
+		// The size of a kept interrupted upload is reported to stat requests only, clients like the
+		// OpenSSH sftp client send them for the offset to resume at with "reput". Listings show the
+		// stored size, which matches what is read from the file.
+		return fs.statList(r.Filepath, true)
+	}
+
+	return nil, errors.ErrUnsupported
+}
+
+// Lstat handles lstat requests. There are no symlinks, they are answered like stat requests,
+// but report the stored size of files with a kept interrupted upload, like listings do.
+func (fs *root) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fs.log.Debug().
+		Str("file-path", r.Filepath).
+		Msg("Lstat called")
+
+	return fs.statList(r.Filepath, false)
+}
+
+// statList returns the file info of the resource at p as the single entry of a list
+func (fs *root) statList(p string, resumed bool) (sftp.ListerAt, error) {
+	fi, err := fs.stat(p, resumed)
+	if err != nil {
+		return nil, sftpError(err)
 	}
 
-	return nil, errors.New("unsupported")
+	list := listerat{fi}
+	fs.setOwners(list)
+	return list, nil
 }
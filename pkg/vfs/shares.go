@@ -0,0 +1,302 @@
+package vfs
+
+import (
+	"os"
+	"strings"
+
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// pendingDirName is the virtual directory in the shares which holds the shares not accepted yet.
+// It is not listed, like the trash.
+const pendingDirName = ".pending"
+
+// pendingPathError is returned when a path within the .pending directory is resolved to a resource.
+// Pending shares are accepted by moving them into the shares and declined by removing them.
+type pendingPathError struct {
+	// name is the entry below the .pending directory, empty for the directory itself
+	name string
+}
+
+func (e *pendingPathError) Error() string {
+	return "pending shares can only be accepted or declined"
+}
+
+func (e *pendingPathError) Unwrap() error {
+	return os.ErrPermission
+}
+
+// pendingPath returns the path below the .pending directory if rel, relative to the root of spc, is within it
+func pendingPath(spc *provider.StorageSpace, rel string) (string, bool) {
+	if spc.GetSpaceType() != "virtual" {
+		return "", false
+	}
+
+	rest, ok := strings.CutPrefix(rel, "/"+pendingDirName)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(rest, "/"), true
+}
+
+// shareRoot returns the mount point of the share at rel, relative to the root of spc,
+// if it is the root of an accepted share
+func shareRoot(spc *provider.StorageSpace, rel string) (string, bool) {
+	if spc.GetSpaceType() != "virtual" {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(rel, "/")
+	if name == "" || name == pendingDirName || strings.Contains(name, "/") {
+		return "", false
+	}
+
+	return name, true
+}
+
+// receivedShares returns the shares received by the user which are in the given state
+func (fs *root) receivedShares(state collaboration.ShareState) ([]*collaboration.ReceivedShare, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	listResp, err := client.ListReceivedShares(fs.authCtx, &collaboration.ListReceivedSharesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs3Error("list received shares", listResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	var shares []*collaboration.ReceivedShare
+	for _, rs := range listResp.GetShares() {
+		if rs.GetState() == state {
+			shares = append(shares, rs)
+		}
+	}
+
+	return shares, nil
+}
+
+// pendingShare is a share which has not been accepted yet, along with the shared resource
+type pendingShare struct {
+	share *collaboration.ReceivedShare
+	info  *provider.ResourceInfo
+}
+
+// pendingShares returns the pending shares by their name in the .pending directory. Shares are named after
+// the shared resource. Shares of resources with the same name get the start of their id appended.
+func (fs *root) pendingShares() (map[string]pendingShare, error) {
+	shares, err := fs.receivedShares(collaboration.ShareState_SHARE_STATE_PENDING)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string][]pendingShare{}
+	for _, rs := range shares {
+		info, err := fs.statRef(&provider.Reference{ResourceId: rs.GetShare().GetResourceId()})
+		if err != nil {
+			fs.log.Debug().Err(err).Str("share", rs.GetShare().GetId().GetOpaqueId()).Msg("Could not stat pending share")
+			continue
+		}
+		if info == nil {
+			// the shared resource is gone
+			continue
+		}
+
+		name := pathSegment(info.GetName())
+		byName[name] = append(byName[name], pendingShare{share: rs, info: info})
+	}
+
+	pending := make(map[string]pendingShare, len(shares))
+	for name, ps := range byName {
+		if len(ps) == 1 {
+			pending[name] = ps[0]
+			continue
+		}
+
+		for _, p := range ps {
+			pending[name+" ("+shortShareID(p.share)+")"] = p
+		}
+	}
+
+	return pending, nil
+}
+
+// listPending lists the .pending directory
+func (fs *root) listPending(name string) ([]os.FileInfo, error) {
+	if name != "" {
+		// pending shares are not mounted yet, their content can't be listed
+		return nil, os.ErrPermission
+	}
+
+	pending, err := fs.pendingShares()
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := make([]os.FileInfo, 0, len(pending))
+	for name, p := range pending {
+		fileInfos = append(fileInfos, pendingFileInfo(name, p))
+	}
+
+	return fileInfos, nil
+}
+
+// statPending returns the file info of the .pending directory or of a pending share in it
+func (fs *root) statPending(name string) (os.FileInfo, error) {
+	if name == "" {
+		return fileInfo{name: pendingDirName, mode: os.FileMode(0755) | os.ModeDir, isDir: true}, nil
+	}
+
+	pending, err := fs.pendingShares()
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := pending[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return pendingFileInfo(name, p), nil
+}
+
+// pendingFileInfo returns the file info of a pending share, which is that of the shared resource
+func pendingFileInfo(name string, p pendingShare) fileInfo {
+	fi := toFileInfos(p.info)[0].(fileInfo)
+	fi.name = name
+
+	return fi
+}
+
+// acceptShare accepts the pending share with the given name and mounts it in the shares at mountPoint
+func (fs *root) acceptShare(name, mountPoint string) error {
+	pending, err := fs.pendingShares()
+	if err != nil {
+		return err
+	}
+
+	p, ok := pending[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	accepted, err := fs.receivedShares(collaboration.ShareState_SHARE_STATE_ACCEPTED)
+	if err != nil {
+		return err
+	}
+	for _, rs := range accepted {
+		if rs.GetMountPoint().GetPath() == mountPoint {
+			return os.ErrExist
+		}
+	}
+
+	return fs.updateReceivedShare(&collaboration.ReceivedShare{
+		Share:      p.share.GetShare(),
+		State:      collaboration.ShareState_SHARE_STATE_ACCEPTED,
+		MountPoint: &provider.Reference{Path: mountPoint},
+	}, "state", "mount_point")
+}
+
+// declineShare declines the pending share with the given name
+func (fs *root) declineShare(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return os.ErrPermission
+	}
+
+	pending, err := fs.pendingShares()
+	if err != nil {
+		return err
+	}
+
+	p, ok := pending[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	return fs.updateReceivedShare(&collaboration.ReceivedShare{
+		Share: p.share.GetShare(),
+		State: collaboration.ShareState_SHARE_STATE_REJECTED,
+	}, "state")
+}
+
+// unmountShare declines the accepted shares mounted at mountPoint, which removes them from the shares
+// while the shared resource is kept. A resource shared with the user more than once, directly and through
+// a group, is mounted once for all of its shares, so each of them is declined.
+func (fs *root) unmountShare(mountPoint string) error {
+	accepted, err := fs.receivedShares(collaboration.ShareState_SHARE_STATE_ACCEPTED)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for _, rs := range accepted {
+		if rs.GetMountPoint().GetPath() != mountPoint {
+			continue
+		}
+
+		found = true
+		err := fs.updateReceivedShare(&collaboration.ReceivedShare{
+			Share: rs.GetShare(),
+			State: collaboration.ShareState_SHARE_STATE_REJECTED,
+		}, "state")
+		if err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return os.ErrNotExist
+	}
+
+	return nil
+}
+
+// updateReceivedShare updates the given fields of a received share
+func (fs *root) updateReceivedShare(rs *collaboration.ReceivedShare, fields ...string) error {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	updateResp, err := client.UpdateReceivedShare(fs.authCtx, &collaboration.UpdateReceivedShareRequest{
+		Share:      rs,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: fields},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("update received share", updateResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("share", rs.GetShare().GetId().GetOpaqueId()).
+			Str("state", rs.GetState().String()).
+			Str("code", updateResp.GetStatus().GetCode().String()).
+			Msg("Could not update received share")
+		return err
+	}
+
+	return nil
+}
+
+// shortShareID returns the start of the share id, which tells apart shares of resources with the same name
+func shortShareID(rs *collaboration.ReceivedShare) string {
+	id := rs.GetShare().GetId().GetOpaqueId()
+	// share ids are prefixed with the storage and space of the shared resource
+	if i := strings.LastIndex(id, "!"); i >= 0 {
+		id = id[i+1:]
+	}
+
+	if len(id) > 8 {
+		id = id[:8]
+	}
+
+	return id
+}
@@ -0,0 +1,313 @@
+package vfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	ctxpkg "github.com/opencloud-eu/reva/v2/pkg/ctx"
+	"github.com/opencloud-eu/reva/v2/pkg/rgrpc/todo/pool"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/metadata"
+)
+
+// stagingPrefix marks the hidden temporary resources uploads are written to before they are moved onto their target
+const stagingPrefix = ".~sftp-upload-"
+
+// isStagingName reports whether name is the name of a temporary upload resource
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix)
+}
+
+// stagingRef returns a reference to a new temporary resource next to the target
+func stagingRef(target *provider.Reference) *provider.Reference {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+
+	return &provider.Reference{
+		ResourceId: target.GetResourceId(),
+		Path:       path.Join(path.Dir(target.GetPath()), stagingPrefix+hex.EncodeToString(suffix)),
+	}
+}
+
+// stagedUpload records a temporary upload resource, so that it can be removed if the service
+// crashes before the upload is published
+type stagedUpload struct {
+	User      string    `json:"user"`
+	StorageID string    `json:"storage_id"`
+	SpaceID   string    `json:"space_id"`
+	OpaqueID  string    `json:"opaque_id"`
+	Path      string    `json:"path"`
+	Created   time.Time `json:"created"`
+}
+
+func (u *stagedUpload) ref() *provider.Reference {
+	return &provider.Reference{
+		ResourceId: &provider.ResourceId{StorageId: u.StorageID, SpaceId: u.SpaceID, OpaqueId: u.OpaqueID},
+		Path:       u.Path,
+	}
+}
+
+// stagingJournal keeps one file per temporary upload resource which currently exists in storage
+type stagingJournal struct {
+	dir string
+
+	mu sync.Mutex
+	// active holds the entries of uploads in progress, all other entries are orphans
+	active map[string]bool
+}
+
+func newStagingJournal(cfg config.Uploads) (*stagingJournal, error) {
+	if err := os.MkdirAll(cfg.StagingDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload staging dir: %w", err)
+	}
+
+	return &stagingJournal{
+		dir:    cfg.StagingDir,
+		active: map[string]bool{},
+	}, nil
+}
+
+// add records a temporary upload resource and returns the id of the entry
+func (j *stagingJournal) add(user string, ref *provider.Reference) (string, error) {
+	id := strings.TrimPrefix(path.Base(ref.GetPath()), stagingPrefix)
+
+	raw, err := json.Marshal(&stagedUpload{
+		User:      user,
+		StorageID: ref.GetResourceId().GetStorageId(),
+		SpaceID:   ref.GetResourceId().GetSpaceId(),
+		OpaqueID:  ref.GetResourceId().GetOpaqueId(),
+		Path:      ref.GetPath(),
+		Created:   time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.WriteFile(j.entryPath(id), raw, 0600); err != nil {
+		return "", fmt.Errorf("failed to record staged upload: %w", err)
+	}
+
+	j.active[id] = true
+	return id, nil
+}
+
+// remove drops the entry once the temporary resource has been moved or deleted
+func (j *stagingJournal) remove(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.active, id)
+	_ = os.Remove(j.entryPath(id))
+}
+
+// abandon hands the entry over to the janitor, if the temporary resource could not be deleted
+func (j *stagingJournal) abandon(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.active, id)
+}
+
+// orphans returns the entries left behind by a previous run of the service or by failed cleanups
+func (j *stagingJournal) orphans() map[string]*stagedUpload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(j.dir, "*.json"))
+	if err != nil {
+		return nil
+	}
+
+	orphans := map[string]*stagedUpload{}
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		u := &stagedUpload{}
+		if err := json.Unmarshal(raw, u); err != nil {
+			_ = os.Remove(f)
+			continue
+		}
+
+		if id := strings.TrimSuffix(filepath.Base(f), ".json"); !j.active[id] {
+			orphans[id] = u
+		}
+	}
+
+	return orphans
+}
+
+func (j *stagingJournal) entryPath(id string) string {
+	return filepath.Join(j.dir, id+".json")
+}
+
+// stagingJanitor deletes temporary upload resources left behind by a crashed service or by failed cleanups. Since they
+// belong to sessions which no longer exist, it impersonates their owners via machine auth.
+type stagingJanitor struct {
+	journal    *stagingJournal
+	gwSelector *pool.Selector[gateway.GatewayAPIClient]
+	apiKey     string
+	interval   time.Duration
+	log        zerolog.Logger
+}
+
+// run cleans up right away and then retries remaining entries periodically
+func (j *stagingJanitor) run() {
+	j.cleanup()
+
+	if j.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		j.cleanup()
+	}
+}
+
+func (j *stagingJanitor) cleanup() {
+	for id, u := range j.journal.orphans() {
+		if err := j.delete(u); err != nil {
+			j.log.Debug().
+				Err(err).
+				Str("path", u.Path).
+				Msg("Could not remove orphaned upload, will retry")
+			continue
+		}
+
+		j.journal.remove(id)
+
+		j.log.Debug().
+			Str("path", u.Path).
+			Msg("Removed orphaned upload")
+	}
+}
+
+func (j *stagingJanitor) delete(u *stagedUpload) error {
+	client, err := j.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	authRes, err := client.Authenticate(context.Background(), &gateway.AuthenticateRequest{
+		Type:         "machine",
+		ClientId:     "userid:" + u.User,
+		ClientSecret: j.apiKey,
+	})
+	if err != nil {
+		return err
+	}
+	if authRes.GetStatus().GetCode() != rpc.Code_CODE_OK {
+		return fmt.Errorf("impersonation failed: %s", authRes.GetStatus().GetMessage())
+	}
+
+	ctx := ctxpkg.ContextSetUser(context.Background(), authRes.GetUser())
+	ctx = metadata.AppendToOutgoingContext(ctx, ctxpkg.TokenHeader, authRes.GetToken())
+
+	deleteResp, err := client.Delete(ctx, &provider.DeleteRequest{Ref: u.ref()})
+	if err != nil {
+		return err
+	}
+
+	switch deleteResp.GetStatus().GetCode() {
+	case rpc.Code_CODE_OK, rpc.Code_CODE_NOT_FOUND:
+		return nil
+	default:
+		return fmt.Errorf("delete failed: %s", deleteResp.GetStatus().GetMessage())
+	}
+}
+
+// publish stores the content so that the target never holds partial content. A new file is uploaded to
+// a temporary resource next to the target, which is moved onto the target afterwards. An existing file
+// is uploaded to directly, as it can't be moved onto. The storage provider only replaces its content
+// once the upload is complete, and the file keeps its id and versions. If etag is set, publishing fails
+// if the target has been changed meanwhile.
+func (fs *root) publish(target *provider.Reference, content *writeBuffer, size int64, etag string) (string, error) {
+	info, err := fs.statRef(target)
+	if err != nil {
+		return "", err
+	}
+	if info != nil {
+		return fs.upload(target, content, size, etag)
+	}
+
+	tmp := stagingRef(target)
+
+	id, err := fs.staging.add(fs.userID, tmp)
+	if err != nil {
+		return "", err
+	}
+
+	published := false
+	defer func() {
+		// an entry is only dropped once the temporary resource is gone, otherwise the janitor removes it later
+		if published || fs.deleteStaged(tmp) {
+			fs.staging.remove(id)
+		} else {
+			fs.staging.abandon(id)
+		}
+	}()
+
+	if _, err := fs.upload(tmp, content, size, ""); err != nil {
+		return "", err
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return "", err
+	}
+
+	moveResp, err := client.Move(fs.authCtx, &provider.MoveRequest{Source: tmp, Destination: target})
+	if err != nil {
+		return "", err
+	}
+	if err := cs3Error("publish upload", moveResp.GetStatus()); err != nil {
+		return "", err
+	}
+	published = true
+
+	statResp, err := client.Stat(fs.authCtx, &provider.StatRequest{Ref: target})
+	if err != nil || statResp.GetStatus().GetCode() != rpc.Code_CODE_OK {
+		return "", nil
+	}
+
+	return statResp.GetInfo().GetEtag(), nil
+}
+
+// deleteStaged removes a temporary upload resource which is not going to be published
+func (fs *root) deleteStaged(tmp *provider.Reference) bool {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		fs.log.Debug().Err(err).Str("path", tmp.GetPath()).Msg("Could not remove staged upload")
+		return false
+	}
+
+	deleteResp, err := client.Delete(fs.authCtx, &provider.DeleteRequest{Ref: tmp})
+	if err != nil {
+		fs.log.Debug().Err(err).Str("path", tmp.GetPath()).Msg("Could not remove staged upload")
+		return false
+	}
+
+	code := deleteResp.GetStatus().GetCode()
+	return code == rpc.Code_CODE_OK || code == rpc.Code_CODE_NOT_FOUND
+}
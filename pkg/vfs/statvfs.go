@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// statvfsBlockSize is the block size quotas are reported in
+	statvfsBlockSize = 4096
+	// statvfsUnlimited is the free space reported for spaces without a quota. It is kept well below
+	// the uint64 range, since clients multiply the block counts with the block size.
+	statvfsUnlimited = 1 << 50
+	// statvfsNameMax is the maximum length of a file name
+	statvfsNameMax = 255
+)
+
+// StatVFS answers statvfs@openssh.com requests with the quota of the space containing the path.
+// The root and the other directories of the layout, which belong to no space, report the quota of the personal space.
+func (fs *root) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	fs.log.Debug().
+		Str("path", r.Filepath).
+		Msg("StatVFS called")
+
+	storageSpaces, err := fs.listStorageSpaces()
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	mounts := fs.mounts(storageSpaces)
+
+	var spc *provider.StorageSpace
+	if m, _ := findMount(mounts, r.Filepath); m != nil {
+		spc = m.space
+	} else if _, ok := virtualDir(mounts, r.Filepath); ok {
+		spc = fs.personalSpace(storageSpaces)
+	}
+
+	if spc == nil {
+		return nil, os.ErrNotExist
+	}
+
+	total, used, remaining, err := fs.quota(spc)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	// The storage reports no total for unlimited spaces
+	if total == 0 {
+		remaining = min(remaining, statvfsUnlimited)
+		total = used + remaining
+	}
+
+	free := remaining / statvfsBlockSize
+
+	return &sftp.StatVFS{
+		Bsize:   statvfsBlockSize,
+		Frsize:  statvfsBlockSize,
+		Blocks:  total / statvfsBlockSize,
+		Bfree:   free,
+		Bavail:  free,
+		Namemax: statvfsNameMax,
+	}, nil
+}
+
+// quota returns the total, used and remaining bytes of the space. A total of zero means that the space has no quota.
+func (fs *root) quota(spc *provider.StorageSpace) (total, used, remaining uint64, err error) {
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.GetId().GetOpaqueId(), "/")
+	if err != nil {
+		fs.log.Debug().Err(err).Msg("makeStorageSpaceReference error in quota")
+		return 0, 0, 0, err
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	resp, err := client.GetQuota(fs.authCtx, &gateway.GetQuotaRequest{
+		Ref: &ref,
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	switch resp.GetStatus().GetCode() {
+	case rpc.Code_CODE_OK:
+	case rpc.Code_CODE_UNIMPLEMENTED:
+		// spaces without quota support, like the share jail, are reported as unlimited
+		return 0, 0, statvfsUnlimited, nil
+	default:
+		return 0, 0, 0, cs3Error("get quota", resp.GetStatus())
+	}
+
+	total = resp.GetTotalBytes()
+	used = resp.GetUsedBytes()
+
+	remaining = statvfsUnlimited
+	if total > 0 {
+		remaining = total - min(used, total)
+	}
+
+	// the storage provider reports the remaining bytes separately, they may be limited by the disk
+	if entry := resp.GetOpaque().GetMap()["remaining"]; entry != nil && entry.GetDecoder() == "plain" {
+		if r, err := strconv.ParseUint(string(entry.GetValue()), 10, 64); err == nil {
+			remaining = min(remaining, r)
+		}
+	}
+
+	return total, used, remaining, nil
+}
+
+// personalSpace returns the personal space of the user, or nil
+func (fs *root) personalSpace(spaces []*provider.StorageSpace) *provider.StorageSpace {
+	for _, spc := range spaces {
+		if spc.GetSpaceType() == "personal" && spc.GetOwner().GetId().GetOpaqueId() == fs.userID {
+			return spc
+		}
+	}
+
+	return nil
+}
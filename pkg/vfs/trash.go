@@ -0,0 +1,383 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// trashDirName is the virtual directory at the root of a space which holds its recycle bin.
+// It is not listed in the space root, so that clients mirroring a space do not copy the trash.
+const trashDirName = ".trash"
+
+// trashPathError is returned when a path within a .trash directory is resolved to a resource of a space.
+// Trash items are no resources, they can only be read, restored by renaming them out of the trash or purged.
+type trashPathError struct {
+	space *provider.StorageSpace
+	// path is the path below the .trash directory, empty for the directory itself
+	path string
+}
+
+func (e *trashPathError) Error() string {
+	return "trash items can only be read, restored or purged"
+}
+
+func (e *trashPathError) Unwrap() error {
+	return os.ErrPermission
+}
+
+// trashPath returns the path below the .trash directory if rel, relative to the root of m, is within it.
+// Only spaces which keep a recycle bin and are mounted as a whole have a .trash directory.
+func trashPath(m *mount, rel string) (string, bool) {
+	if m.base != "" {
+		return "", false
+	}
+
+	switch m.space.GetSpaceType() {
+	case "personal", "project":
+	default:
+		return "", false
+	}
+
+	rest, ok := strings.CutPrefix(rel, "/"+trashDirName)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+
+	return rest, true
+}
+
+// trashName returns the name of a trash item. Items at the top of the trash are named after their original
+// name followed by the start of their key, as several items deleted from the same path may be kept.
+func trashName(item *provider.RecycleItem) string {
+	key := item.GetKey()
+	if strings.Contains(key, "/") {
+		return path.Base(key)
+	}
+
+	if len(key) > 8 {
+		key = key[:8]
+	}
+
+	return path.Base(item.GetRef().GetPath()) + "~" + key
+}
+
+// listRecycle lists the trash of spc, or the content of the deleted directory with the given key
+func (fs *root) listRecycle(spc *provider.StorageSpace, key string) ([]*provider.RecycleItem, error) {
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		// without the trailing slash, the item itself is listed instead of its content
+		key += "/"
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	listResp, err := client.ListRecycle(fs.authCtx, &provider.ListRecycleRequest{
+		Ref: &ref,
+		Key: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs3Error("list recycle", listResp.GetStatus()); err != nil {
+		return nil, err
+	}
+
+	return listResp.GetRecycleItems(), nil
+}
+
+// trashItem returns the trash item at p, a path below the .trash directory of spc
+func (fs *root) trashItem(spc *provider.StorageSpace, p string) (*provider.RecycleItem, error) {
+	dir, name := path.Split(strings.TrimPrefix(p, "/"))
+	if name == "" {
+		return nil, os.ErrNotExist
+	}
+
+	key := ""
+	if dir != "" {
+		parent, err := fs.trashItem(spc, path.Clean("/"+dir))
+		if err != nil {
+			return nil, err
+		}
+		if parent.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			return nil, syscall.ENOTDIR
+		}
+		key = parent.GetKey()
+	}
+
+	items, err := fs.listRecycle(spc, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if trashName(item) == name {
+			return item, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// listTrash lists the directory at p below the .trash directory of spc
+func (fs *root) listTrash(spc *provider.StorageSpace, p string) ([]os.FileInfo, error) {
+	key := ""
+	if p != "" {
+		item, err := fs.trashItem(spc, p)
+		if err != nil {
+			return nil, err
+		}
+		if item.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			return nil, syscall.ENOTDIR
+		}
+		key = item.GetKey()
+	}
+
+	items, err := fs.listRecycle(spc, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := make([]os.FileInfo, 0, len(items))
+	for _, item := range items {
+		fileInfos = append(fileInfos, trashFileInfo(item))
+	}
+
+	return fileInfos, nil
+}
+
+// statTrash returns the file info of p below the .trash directory of spc
+func (fs *root) statTrash(spc *provider.StorageSpace, p string) (os.FileInfo, error) {
+	if p == "" {
+		return fileInfo{name: trashDirName, mode: os.FileMode(0755) | os.ModeDir, isDir: true}, nil
+	}
+
+	item, err := fs.trashItem(spc, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return trashFileInfo(item), nil
+}
+
+// trashFileInfo returns the file info of a trash item, its modification time is the time it was deleted
+func trashFileInfo(item *provider.RecycleItem) fileInfo {
+	fi := fileInfo{
+		name: trashName(item),
+		size: int64(item.GetSize()),
+		mode: os.FileMode(0644),
+	}
+
+	if item.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		fi.mode = os.FileMode(0755) | os.ModeDir
+		fi.isDir = true
+	}
+
+	if item.GetDeletionTime() != nil {
+		fi.mtime = time.Unix(int64(item.GetDeletionTime().GetSeconds()), 0)
+	}
+
+	return fi
+}
+
+// openTrashFile opens the trash item at p for reading. The CS3 API has no download of recycle items, so the
+// item at the top of the trash which holds it is restored to its original location, the file is copied into
+// a buffer and the item is deleted again. Storage providers which key trash items by resource id, like
+// decomposedfs, keep the key and thereby the name of the item, only its deletion time changes.
+func (fs *root) openTrashFile(spc *provider.StorageSpace, p string) (io.ReaderAt, error) {
+	item, err := fs.trashItem(spc, p)
+	if err != nil {
+		return nil, err
+	}
+	if item.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return nil, syscall.EISDIR
+	}
+
+	top := item
+	first, _, nested := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if nested {
+		if top, err = fs.trashItem(spc, "/"+first); err != nil {
+			return nil, err
+		}
+	}
+	_, rel, _ := strings.Cut(item.GetKey(), "/")
+
+	origin, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), top.GetRef().GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	// restoring elsewhere would change the original location the item is deleted from again
+	info, err := fs.statRef(&origin)
+	if err != nil {
+		return nil, err
+	}
+	if info != nil {
+		return nil, fmt.Errorf("the original location %s of the deleted item is taken, restore the item to read it: %w",
+			top.GetRef().GetPath(), os.ErrExist)
+	}
+
+	restored, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), path.Join(top.GetRef().GetPath(), rel))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.restoreRecycleItem(spc, top.GetKey(), &origin); err != nil {
+		return nil, err
+	}
+
+	buffer, readErr := fs.readRestored(&restored, int64(item.GetSize()))
+
+	if err := fs.deleteRef(&origin); err != nil {
+		fs.log.Error().
+			Err(err).
+			Str("path", top.GetRef().GetPath()).
+			Msg("Read a deleted file, but could not move it back to the trash")
+		if buffer != nil {
+			_ = buffer.Close()
+		}
+		return nil, fmt.Errorf("restored to read, but could not move back to the trash: %w", err)
+	}
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	return buffer, nil
+}
+
+// readRestored copies the content of the restored file at ref into a write buffer
+func (fs *root) readRestored(ref *provider.Reference, size int64) (*writeBuffer, error) {
+	buffer := fs.spool.newBuffer()
+
+	reader := newRangeReader(fs, ref, size)
+	defer reader.Close()
+
+	if _, err := io.Copy(io.NewOffsetWriter(buffer, 0), io.NewSectionReader(reader, 0, size)); err != nil {
+		_ = buffer.Close()
+		return nil, err
+	}
+
+	return buffer, nil
+}
+
+// restoreTrashItem restores the trash item at p below the .trash directory of spc to target,
+// which has to be in the same space
+func (fs *root) restoreTrashItem(spc *provider.StorageSpace, p string, target *provider.Reference) error {
+	if p == "" {
+		return os.ErrPermission
+	}
+
+	item, err := fs.trashItem(spc, p)
+	if err != nil {
+		return err
+	}
+
+	return fs.restoreRecycleItem(spc, item.GetKey(), target)
+}
+
+// restoreRecycleItem restores the trash item of spc with the given key to target
+func (fs *root) restoreRecycleItem(spc *provider.StorageSpace, key string, target *provider.Reference) error {
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), "")
+	if err != nil {
+		return err
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	restoreResp, err := client.RestoreRecycleItem(fs.authCtx, &provider.RestoreRecycleItemRequest{
+		Ref:        &ref,
+		Key:        key,
+		RestoreRef: target,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("restore", restoreResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("key", key).
+			Str("code", restoreResp.GetStatus().GetCode().String()).
+			Msg("Could not restore trash item")
+		return err
+	}
+
+	return nil
+}
+
+// purgeTrashItem deletes the trash item at p below the .trash directory of spc for good.
+// As with resources, directories are only purged through rmdir and only when they are empty.
+func (fs *root) purgeTrashItem(spc *provider.StorageSpace, p string, dir bool) error {
+	if p == "" {
+		return os.ErrPermission
+	}
+
+	item, err := fs.trashItem(spc, p)
+	if err != nil {
+		return err
+	}
+
+	isDir := item.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER
+	switch {
+	case isDir && !dir:
+		return os.ErrInvalid
+	case !isDir && dir:
+		return syscall.ENOTDIR
+	case isDir:
+		children, err := fs.listRecycle(spc, item.GetKey())
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return errNotEmpty
+		}
+	}
+
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), "")
+	if err != nil {
+		return err
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	purgeResp, err := client.PurgeRecycle(fs.authCtx, &provider.PurgeRecycleRequest{
+		Ref: &ref,
+		Key: item.GetKey(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("purge", purgeResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("key", item.GetKey()).
+			Str("code", purgeResp.GetStatus().GetCode().String()).
+			Msg("Could not purge trash item")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+)
+
+const (
+	tusResumable = "1.0.0"
+	// tusMaxRetries is the number of times a failed chunk is retried from the offset reported by the server
+	tusMaxRetries = 3
+)
+
+// upload stores size bytes of content at ref. Uploads reaching the configured threshold are sent in chunks
+// using TUS, smaller ones with a single PUT. If etag is set, the upload fails if the file has changed meanwhile.
+// It returns the new etag of the file, if the data gateway reports one.
+func (fs *root) upload(ref *provider.Reference, content io.ReaderAt, size int64, etag string) (string, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return "", err
+	}
+
+	// Prepare upload request
+	opaque := &types.Opaque{
+		Map: map[string]*types.OpaqueEntry{
+			"Upload-Length": {
+				Decoder: "plain",
+				Value:   []byte(strconv.FormatInt(size, 10)),
+			},
+		},
+	}
+
+	uploadReq := &provider.InitiateFileUploadRequest{
+		Ref:    ref,
+		Opaque: opaque,
+	}
+
+	// Add etag for conflict detection if we have one
+	if etag != "" {
+		uploadReq.Options = &provider.InitiateFileUploadRequest_IfMatch{
+			IfMatch: etag,
+		}
+	}
+
+	resp, err := client.InitiateFileUpload(fs.authCtx, uploadReq)
+	if err != nil {
+		return "", err
+	}
+	if err := cs3Error("initiate upload", resp.GetStatus()); err != nil {
+		return "", err
+	}
+
+	var simpleEndpoint, tusEndpoint *transferEndpoint
+	for _, proto := range resp.GetProtocols() {
+		ep := &transferEndpoint{url: proto.GetUploadEndpoint(), token: proto.GetToken()}
+		switch proto.GetProtocol() {
+		case "simple", "spaces":
+			if simpleEndpoint == nil {
+				simpleEndpoint = ep
+			}
+		case "tus":
+			tusEndpoint = ep
+		}
+	}
+
+	// InitiateFileUpload already created the upload, which corresponds to the TUS creation request,
+	// so only the content has to be sent.
+	if tusEndpoint != nil && size > 0 && size >= fs.uploads.TusThreshold {
+		return fs.tusUpload(*tusEndpoint, content, size)
+	}
+
+	if simpleEndpoint == nil {
+		return "", fmt.Errorf("no suitable upload protocol found")
+	}
+
+	return fs.simpleUpload(*simpleEndpoint, content, size)
+}
+
+// simpleUpload sends the content with a single PUT request
+func (fs *root) simpleUpload(ep transferEndpoint, content io.ReaderAt, size int64) (string, error) {
+	var body io.Reader = io.NewSectionReader(content, 0, size)
+	if size == 0 {
+		// an empty body of unknown length would be sent chunked, which data gateways may refuse
+		body = http.NoBody
+	}
+
+	httpReq, err := fs.newTransferRequest(http.MethodPut, ep, body)
+	if err != nil {
+		return "", err
+	}
+
+	httpReq.ContentLength = size
+
+	// Execute upload
+	httpResp, err := fs.httpClient.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(httpResp.Body)
+		fs.log.Debug().Int("status", httpResp.StatusCode).Str("body", string(body)).Msg("Upload failed")
+		return "", httpError("upload", httpResp.StatusCode)
+	}
+
+	return httpResp.Header.Get("ETag"), nil
+}
+
+// tusUpload sends the content in chunks of the configured size with TUS PATCH requests.
+// A failed chunk is retried from the offset the server has actually received.
+func (fs *root) tusUpload(ep transferEndpoint, content io.ReaderAt, size int64) (string, error) {
+	var offset int64
+	var etag string
+	retries := 0
+
+	for offset < size {
+		chunk := min(fs.uploads.TusChunkSize, size-offset)
+
+		newOffset, chunkEtag, err := fs.tusPatch(ep, io.NewSectionReader(content, offset, chunk), offset, chunk)
+		if err != nil {
+			if retries >= tusMaxRetries {
+				return "", err
+			}
+			retries++
+
+			fs.log.Debug().
+				Err(err).
+				Int64("offset", offset).
+				Int("retry", retries).
+				Msg("TUS chunk failed, resuming from server offset")
+
+			if offset, err = fs.tusOffset(ep); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if newOffset <= offset {
+			return "", fmt.Errorf("tus upload made no progress at offset %d", offset)
+		}
+
+		retries = 0
+		offset = newOffset
+		if chunkEtag != "" {
+			etag = chunkEtag
+		}
+	}
+
+	return etag, nil
+}
+
+// tusPatch sends a single chunk and returns the offset reported by the server
+func (fs *root) tusPatch(ep transferEndpoint, chunk io.Reader, offset, length int64) (int64, string, error) {
+	httpReq, err := fs.newTransferRequest(http.MethodPatch, ep, chunk)
+	if err != nil {
+		return 0, "", err
+	}
+
+	httpReq.ContentLength = length
+	httpReq.Header.Set("Content-Type", "application/offset+octet-stream")
+	httpReq.Header.Set("Tus-Resumable", tusResumable)
+	httpReq.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	httpResp, err := fs.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, "", err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusNoContent && httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(httpResp.Body)
+		fs.log.Debug().Int("status", httpResp.StatusCode).Str("body", string(body)).Msg("Upload failed")
+		return 0, "", httpError("upload", httpResp.StatusCode)
+	}
+
+	newOffset, err := strconv.ParseInt(httpResp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid upload offset in response: %w", err)
+	}
+
+	return newOffset, httpResp.Header.Get("ETag"), nil
+}
+
+// tusOffset asks the server how many bytes of the upload it has received
+func (fs *root) tusOffset(ep transferEndpoint) (int64, error) {
+	httpReq, err := fs.newTransferRequest(http.MethodHead, ep, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	httpReq.Header.Set("Tus-Resumable", tusResumable)
+
+	httpResp, err := fs.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusNoContent {
+		return 0, httpError("upload offset request", httpResp.StatusCode)
+	}
+
+	return strconv.ParseInt(httpResp.Header.Get("Upload-Offset"), 10, 64)
+}
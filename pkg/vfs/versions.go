@@ -0,0 +1,366 @@
+package vfs
+
+import (
+	"cmp"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/opencloud-eu/reva/v2/pkg/utils"
+)
+
+const (
+	// versionsDirName is the virtual directory in every directory of a space which holds the versions of its
+	// files, as .versions/<file>/<version>. It is not listed, like the trash, and only exists where the
+	// directory has no resource of that name.
+	versionsDirName = ".versions"
+	// versionTimeFormat names versions after their modification time, in the basic format of ISO 8601
+	// which has no colons, as those are not allowed in file names on all clients
+	versionTimeFormat = "20060102T150405Z"
+)
+
+// versionsPathError is returned when a path within a .versions directory is resolved to a resource of a space.
+// Versions are no resources, they can only be read and restored by renaming or copying them onto their file.
+type versionsPathError struct {
+	space *provider.StorageSpace
+	// dir is the directory holding the .versions directory, relative to the space root
+	dir string
+	// file and version are the entries below the .versions directory, empty for the levels above them
+	file    string
+	version string
+}
+
+func (e *versionsPathError) Error() string {
+	return "file versions can only be read or restored"
+}
+
+func (e *versionsPathError) Unwrap() error {
+	return os.ErrPermission
+}
+
+// filePath returns the path of the versioned file relative to the space root
+func (e *versionsPathError) filePath() string {
+	return path.Join(e.dir, e.file)
+}
+
+// versionsPath returns the location of rel, relative to the root of m, if it is within a .versions directory.
+// Directories named .versions which exist in the space are no versions view, paths within them are
+// resolved like any other.
+func (fs *root) versionsPath(m *mount, rel string) (*versionsPathError, bool) {
+	segments := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for i, segment := range segments {
+		if segment != versionsDirName {
+			continue
+		}
+
+		dir := path.Join(append([]string{"/"}, segments[:i]...)...)
+		if fs.hasResource(m.space, path.Join(dir, versionsDirName)) {
+			continue
+		}
+
+		loc := &versionsPathError{space: m.space, dir: dir}
+		rest := segments[i+1:]
+		if len(rest) > 0 {
+			loc.file = rest[0]
+		}
+		if len(rest) > 1 {
+			// deeper paths keep their slashes, so that they match no version
+			loc.version = strings.Join(rest[1:], "/")
+		}
+
+		return loc, true
+	}
+
+	return nil, false
+}
+
+// hasResource reports whether there is a resource at rel, relative to the root of spc. If that can't be
+// told, there is assumed to be none.
+func (fs *root) hasResource(spc *provider.StorageSpace, rel string) bool {
+	ref, err := spacelookup.MakeStorageSpaceReference(spc.Id.GetOpaqueId(), rel)
+	if err != nil {
+		return false
+	}
+
+	info, err := fs.statRef(&ref)
+	if err != nil {
+		fs.log.Debug().Err(err).Str("path", rel).Msg("Could not stat resource")
+		return false
+	}
+
+	return info != nil
+}
+
+// versionsRef returns a reference to the versioned file of loc
+func (fs *root) versionsRef(loc *versionsPathError) (*provider.Reference, error) {
+	ref, err := spacelookup.MakeStorageSpaceReference(loc.space.Id.GetOpaqueId(), loc.filePath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ref, nil
+}
+
+// versionedFile returns a reference to the versioned file of loc and its resource info
+func (fs *root) versionedFile(loc *versionsPathError) (*provider.Reference, *provider.ResourceInfo, error) {
+	ref, err := fs.versionsRef(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := fs.statRef(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info == nil {
+		return nil, nil, os.ErrNotExist
+	}
+	if info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		// directories have no versions
+		return nil, nil, os.ErrNotExist
+	}
+
+	return ref, info, nil
+}
+
+// listFileVersions returns the versions of the file at ref, named after their modification time and ordered by it
+func (fs *root) listFileVersions(ref *provider.Reference) (map[string]*provider.FileVersion, []string, error) {
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listResp, err := client.ListFileVersions(fs.authCtx, &provider.ListFileVersionsRequest{
+		Ref: ref,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cs3Error("list file versions", listResp.GetStatus()); err != nil {
+		return nil, nil, err
+	}
+
+	versions := listResp.GetVersions()
+	slices.SortFunc(versions, func(a, b *provider.FileVersion) int {
+		return cmp.Or(cmp.Compare(a.GetMtime(), b.GetMtime()), strings.Compare(a.GetKey(), b.GetKey()))
+	})
+
+	byName := make(map[string]*provider.FileVersion, len(versions))
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		name := time.Unix(int64(v.GetMtime()), 0).UTC().Format(versionTimeFormat)
+		// versions written within the same second are told apart by a counter
+		for n := 2; byName[name] != nil; n++ {
+			name = time.Unix(int64(v.GetMtime()), 0).UTC().Format(versionTimeFormat) + "~" + strconv.Itoa(n)
+		}
+
+		byName[name] = v
+		names = append(names, name)
+	}
+
+	return byName, names, nil
+}
+
+// fileVersion returns the version of loc, with a reference to download it and its resource info
+func (fs *root) fileVersion(loc *versionsPathError) (*provider.FileVersion, *provider.Reference, *provider.ResourceInfo, error) {
+	if loc.file == "" || loc.version == "" {
+		return nil, nil, nil, syscall.EISDIR
+	}
+
+	ref, info, err := fs.versionedFile(loc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	versions, _, err := fs.listFileVersions(ref)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	v, ok := versions[loc.version]
+	if !ok {
+		return nil, nil, nil, os.ErrNotExist
+	}
+
+	// versions are downloaded by their key in place of the id of the file, in the space of the file
+	versionRef := &provider.Reference{
+		ResourceId: &provider.ResourceId{
+			StorageId: info.GetId().GetStorageId(),
+			SpaceId:   info.GetId().GetSpaceId(),
+			OpaqueId:  v.GetKey(),
+		},
+		Path: utils.MakeRelativePath(""),
+	}
+
+	versionInfo := &provider.ResourceInfo{
+		Type:  provider.ResourceType_RESOURCE_TYPE_FILE,
+		Id:    versionRef.GetResourceId(),
+		Name:  loc.version,
+		Size:  v.GetSize(),
+		Mtime: &types.Timestamp{Seconds: v.GetMtime()},
+		Etag:  v.GetEtag(),
+	}
+
+	return v, versionRef, versionInfo, nil
+}
+
+// listVersions lists the directory of loc, which is the .versions directory or one of its file directories
+func (fs *root) listVersions(loc *versionsPathError) ([]os.FileInfo, error) {
+	if loc.version != "" {
+		return nil, syscall.ENOTDIR
+	}
+
+	if loc.file == "" {
+		ref, err := spacelookup.MakeStorageSpaceReference(loc.space.Id.GetOpaqueId(), loc.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		infos, err := fs.listRef(&ref)
+		if err != nil {
+			return nil, err
+		}
+
+		fileInfos := make([]os.FileInfo, 0, len(infos))
+		for _, info := range infos {
+			if info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER || isStagingName(info.GetName()) {
+				continue
+			}
+			fileInfos = append(fileInfos, versionsDirInfo(info.GetName(), info))
+		}
+
+		return fileInfos, nil
+	}
+
+	ref, _, err := fs.versionedFile(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, names, err := fs.listFileVersions(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fileInfos = append(fileInfos, versionFileInfo(name, versions[name]))
+	}
+
+	return fileInfos, nil
+}
+
+// statVersions returns the file info of loc
+func (fs *root) statVersions(loc *versionsPathError) (os.FileInfo, error) {
+	switch {
+	case loc.file == "":
+		ref, err := spacelookup.MakeStorageSpaceReference(loc.space.Id.GetOpaqueId(), loc.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := fs.statRef(&ref)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil || info.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			return nil, os.ErrNotExist
+		}
+
+		return versionsDirInfo(versionsDirName, info), nil
+	case loc.version == "":
+		_, info, err := fs.versionedFile(loc)
+		if err != nil {
+			return nil, err
+		}
+
+		return versionsDirInfo(loc.file, info), nil
+	}
+
+	v, _, _, err := fs.fileVersion(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return versionFileInfo(loc.version, v), nil
+}
+
+// versionFileInfo returns the file info of a version, which is read-only
+func versionFileInfo(name string, v *provider.FileVersion) fileInfo {
+	return fileInfo{
+		name:  name,
+		size:  int64(v.GetSize()),
+		mode:  os.FileMode(0444),
+		mtime: time.Unix(int64(v.GetMtime()), 0),
+	}
+}
+
+// versionsDirInfo returns the file info of a directory of the versions view, which takes its time from info
+func versionsDirInfo(name string, info *provider.ResourceInfo) fileInfo {
+	fi := fileInfo{
+		name:  name,
+		mode:  os.FileMode(0555) | os.ModeDir,
+		isDir: true,
+	}
+
+	if info.GetMtime() != nil {
+		fi.mtime = time.Unix(int64(info.GetMtime().Seconds), 0)
+	}
+
+	return fi
+}
+
+// restoreFileVersion makes the version of loc the current content of its file.
+// The current content is kept as a version in turn.
+func (fs *root) restoreFileVersion(loc *versionsPathError) error {
+	v, _, _, err := fs.fileVersion(loc)
+	if err != nil {
+		return err
+	}
+
+	ref, err := fs.versionsRef(loc)
+	if err != nil {
+		return err
+	}
+
+	client, err := fs.gwSelector.Next()
+	if err != nil {
+		return err
+	}
+
+	restoreResp, err := client.RestoreFileVersion(fs.authCtx, &provider.RestoreFileVersionRequest{
+		Ref: ref,
+		Key: v.GetKey(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cs3Error("restore file version", restoreResp.GetStatus()); err != nil {
+		fs.log.Debug().
+			Err(err).
+			Str("path", loc.filePath()).
+			Str("key", v.GetKey()).
+			Str("code", restoreResp.GetStatus().GetCode().String()).
+			Msg("Could not restore file version")
+		return err
+	}
+
+	return nil
+}
+
+// restoresVersion reports whether moving or copying the version of loc to target, a path relative to the root
+// of spc, restores it, which is the case if target is the file of the version
+func restoresVersion(loc *versionsPathError, spc *provider.StorageSpace, target string) bool {
+	return loc.version != "" &&
+		spc.GetId().GetOpaqueId() == loc.space.GetId().GetOpaqueId() &&
+		path.Clean(target) == loc.filePath()
+}
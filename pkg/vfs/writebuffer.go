@@ -0,0 +1,439 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/IljaN/opencloud-sftp/pkg/config"
+)
+
+// spool hands out write buffers. Buffers are kept in memory as long as they fit into the
+// per-handle and the global memory limits, and are spilled to temporary files beyond that.
+type spool struct {
+	dir         string
+	handleLimit int64
+
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// newSpool creates the temp directory and removes files left over from a previous run
+func newSpool(cfg config.Uploads) (*spool, error) {
+	if err := os.MkdirAll(cfg.TempDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload temp dir: %w", err)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(cfg.TempDir, "upload-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range leftovers {
+		if err := os.Remove(f); err != nil {
+			return nil, fmt.Errorf("failed to remove leftover upload: %w", err)
+		}
+	}
+
+	return &spool{
+		dir:         cfg.TempDir,
+		handleLimit: cfg.HandleMemoryLimit,
+		limit:       cfg.MemoryLimit,
+	}, nil
+}
+
+// newBuffer returns an empty write buffer
+func (s *spool) newBuffer() *writeBuffer {
+	return &writeBuffer{spool: s}
+}
+
+// adopt returns a write buffer holding the content of the file at src, which is moved into the temp dir
+func (s *spool) adopt(src string, size int64) (*writeBuffer, error) {
+	f, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload temp file: %w", err)
+	}
+	_ = f.Close()
+
+	if err := moveFile(src, f.Name()); err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	if f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600); err != nil {
+		return nil, err
+	}
+
+	return &writeBuffer{
+		spool:   s,
+		file:    f,
+		size:    size,
+		written: []extent{{0, size}},
+	}, nil
+}
+
+// reserve claims n bytes of the global memory budget
+func (s *spool) reserve(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.used+n > s.limit {
+		return false
+	}
+
+	s.used += n
+	return true
+}
+
+// release returns n bytes to the global memory budget
+func (s *spool) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.used -= n
+}
+
+// writeBuffer collects the content written to a handle until it is uploaded.
+// Writes may arrive in any order, gaps are filled with zeros.
+type writeBuffer struct {
+	spool *spool
+
+	mu sync.RWMutex
+	// mem holds the content while it is kept in memory, its capacity is reserved from the spool
+	mem []byte
+	// file holds the content once it has been spilled to disk
+	file *os.File
+	size int64
+	// written holds the sorted, non-overlapping ranges the client has written
+	written []extent
+}
+
+// extent is a byte range [start, end)
+type extent struct {
+	start, end int64
+}
+
+// WriteAt implements io.WriterAt
+func (b *writeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset not allowed")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	end := off + int64(len(p))
+	if err := b.ensure(end); err != nil {
+		return 0, err
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, off)
+		b.size = max(b.size, off+int64(n))
+		b.markWritten(off, off+int64(n))
+		return n, err
+	}
+
+	n := copy(b.mem[off:], p)
+	b.markWritten(off, off+int64(n))
+	return n, nil
+}
+
+// Append writes p at the end of the content
+func (b *writeBuffer) Append(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	off := b.size
+	if err := b.ensure(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, off)
+		b.markWritten(off, off+int64(n))
+		return n, err
+	}
+
+	n := copy(b.mem[off:], p)
+	b.markWritten(off, off+int64(n))
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (b *writeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if off >= b.size {
+		return 0, io.EOF
+	}
+
+	if len(p) > int(b.size-off) {
+		p = p[:b.size-off]
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.ReadAt(p, off)
+	} else {
+		n = copy(p, b.mem[off:])
+	}
+
+	if err == nil && off+int64(n) >= b.size {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Size returns the current length of the buffered content
+func (b *writeBuffer) Size() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.size
+}
+
+// Truncate changes the length of the buffered content
+func (b *writeBuffer) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size not allowed")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if size > b.size {
+		oldSize := b.size
+		if err := b.ensure(size); err != nil {
+			return err
+		}
+		b.markWritten(oldSize, size)
+		return nil
+	}
+
+	if b.file != nil {
+		if err := b.file.Truncate(size); err != nil {
+			return err
+		}
+	} else {
+		b.mem = b.mem[:size]
+	}
+
+	b.size = size
+	b.clipWritten(size)
+	return nil
+}
+
+// Prefix returns the length of the content which has been written without gaps from the start
+func (b *writeBuffer) Prefix() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.written) == 0 || b.written[0].start != 0 {
+		return 0
+	}
+
+	return b.written[0].end
+}
+
+// persist moves the first size bytes of the content to dst and releases the buffer
+func (b *writeBuffer) persist(dst string, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file == nil {
+		err := os.WriteFile(dst, b.mem[:size], 0600)
+		b.spool.release(int64(cap(b.mem)))
+		b.mem = nil
+		b.size = 0
+		return err
+	}
+
+	f := b.file
+	b.file = nil
+	b.size = 0
+
+	err := f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = moveFile(f.Name(), dst)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Close releases the memory reservation and removes the temp file, if any
+func (b *writeBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.spool.release(int64(cap(b.mem)))
+	b.mem = nil
+	b.size = 0
+
+	if b.file == nil {
+		return nil
+	}
+
+	err := b.file.Close()
+	if rmErr := os.Remove(b.file.Name()); err == nil {
+		err = rmErr
+	}
+	b.file = nil
+
+	return err
+}
+
+// ensure extends the content to at least end bytes, spilling it to disk if it no longer fits into memory
+func (b *writeBuffer) ensure(end int64) error {
+	if end <= b.size {
+		return nil
+	}
+
+	if b.file == nil && !b.growMem(end) {
+		if err := b.spill(); err != nil {
+			return err
+		}
+	}
+
+	if b.file != nil {
+		// the file is extended with zeros by the following write or by truncating it
+		if err := b.file.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	b.size = end
+	return nil
+}
+
+// growMem extends the in-memory content to end bytes. The capacity is doubled to keep
+// sequential appends linear, as far as the memory limits allow.
+func (b *writeBuffer) growMem(end int64) bool {
+	if end <= int64(cap(b.mem)) {
+		old := len(b.mem)
+		b.mem = b.mem[:end]
+		clear(b.mem[old:])
+		return true
+	}
+
+	if end > b.spool.handleLimit {
+		return false
+	}
+
+	oldCap := int64(cap(b.mem))
+	newCap := min(max(end, 2*oldCap), b.spool.handleLimit)
+	if !b.spool.reserve(newCap - oldCap) {
+		newCap = end
+		if !b.spool.reserve(newCap - oldCap) {
+			return false
+		}
+	}
+
+	newMem := make([]byte, end, newCap)
+	copy(newMem, b.mem)
+	b.mem = newMem
+	return true
+}
+
+// spill moves the in-memory content to a temp file
+func (b *writeBuffer) spill() error {
+	f, err := os.CreateTemp(b.spool.dir, "upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create upload temp file: %w", err)
+	}
+
+	if _, err := f.Write(b.mem[:b.size]); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write upload temp file: %w", err)
+	}
+
+	b.spool.release(int64(cap(b.mem)))
+	b.mem = nil
+	b.file = f
+	return nil
+}
+
+// markWritten records that [start, end) has been written
+func (b *writeBuffer) markWritten(start, end int64) {
+	if start >= end {
+		return
+	}
+
+	merged := make([]extent, 0, len(b.written)+1)
+	cur := extent{start, end}
+	inserted := false
+	for _, e := range b.written {
+		switch {
+		case e.end < cur.start:
+			merged = append(merged, e)
+		case cur.end < e.start:
+			if !inserted {
+				merged = append(merged, cur)
+				inserted = true
+			}
+			merged = append(merged, e)
+		default:
+			cur.start = min(cur.start, e.start)
+			cur.end = max(cur.end, e.end)
+		}
+	}
+	if !inserted {
+		merged = append(merged, cur)
+	}
+
+	b.written = merged
+}
+
+// clipWritten drops the written ranges beyond size
+func (b *writeBuffer) clipWritten(size int64) {
+	clipped := b.written[:0]
+	for _, e := range b.written {
+		if e.start >= size {
+			break
+		}
+		e.end = min(e.end, size)
+		clipped = append(clipped, e)
+	}
+	b.written = clipped
+}
+
+// moveFile renames src to dst, falling back to copying if they are on different file systems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
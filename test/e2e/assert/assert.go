@@ -34,3 +34,17 @@ func DirNotExists(t *testing.T, files []os.FileInfo, dirName string) {
 		t.Errorf("Directory '%s' found, but should not exist", dirName)
 	}
 }
+
+func FileExists(t *testing.T, files []os.FileInfo, fileName string) {
+	fileFound := false
+	for _, file := range files {
+		if !file.IsDir() && file.Name() == fileName {
+			fileFound = true
+			break
+		}
+	}
+
+	if !fileFound {
+		t.Errorf("Expected file '%s' not found in file list", fileName)
+	}
+}
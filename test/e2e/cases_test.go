@@ -3,10 +3,24 @@
 package e2e
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/IljaN/opencloud-sftp/test/e2e/assert"
+	"github.com/IljaN/opencloud-sftp/test/e2e/sftp"
 	storageProvider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	pkgsftp "github.com/pkg/sftp"
+	"hash/adler32"
 	"io"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func (ts *TestSuite) TestListRoot(t *testing.T) {
@@ -154,13 +168,17 @@ func (ts *TestSuite) TestUploadFile(t *testing.T) {
 		t.Fatalf("Failed to create file: %v", err)
 	}
 
-	defer file.Close()
-
 	_, err = file.Write(content)
 	if err != nil {
 		t.Fatalf("Failed to upload file: %v", err)
 	}
 
+	// Content is uploaded when the handle is closed
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close uploaded file: %v", err)
+	}
+
 	gw := ts.GetGateway("admin")
 
 	res, err := gw.Stat(fPath)
@@ -267,3 +285,2149 @@ func (ts *TestSuite) TestRenameEmptyFolder(t *testing.T) {
 		t.Fatalf("Old folder %s still exists after rename", err)
 	}
 }
+
+func (ts *TestSuite) TestDownloadFile_PartialRead(t *testing.T) {
+	fPath := "/Admin/PartialRead.bin"
+	content := make([]byte, 3<<20)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile(fPath, content)
+	if err != nil {
+		t.Fatalf("Failed to create file for download: %v", err)
+	}
+
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	file, err := sftp.Open(fPath)
+	if err != nil {
+		t.Fatalf("Failed to open file for download: %v", err)
+	}
+	defer file.Close()
+
+	offset := int64(2<<20 + 123)
+	buf := make([]byte, 4096)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil {
+		t.Fatalf("Failed to read at offset %d: %v", offset, err)
+	}
+
+	if !bytes.Equal(buf[:n], content[offset:offset+int64(n)]) {
+		t.Fatalf("Content read at offset %d does not match original content", offset)
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_Empty(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile("/Admin/EmptiedAtomic.txt", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = gw.CreateFile("/Admin/Emptied.txt", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	atomic, atomicCleanup := ts.GetAtomicSFTPClient("admin")
+	defer atomicCleanup()
+
+	// new files and replaced content, uploaded directly and published atomically
+	tests := []struct {
+		client *sftp.Client
+		path   string
+	}{
+		{client, "/Admin/Empty.txt"},
+		{client, "/Admin/Emptied.txt"},
+		{atomic, "/Admin/EmptyAtomic.txt"},
+		{atomic, "/Admin/EmptiedAtomic.txt"},
+	}
+
+	for _, tt := range tests {
+		file, err := tt.client.Create(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", tt.path, err)
+		}
+
+		err = file.Close()
+		if err != nil {
+			t.Fatalf("Failed to close %s: %v", tt.path, err)
+		}
+
+		info, err := gw.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", tt.path, err)
+		}
+		if info.GetSize() != 0 {
+			t.Fatalf("Expected %s to be empty, got size %d", tt.path, info.GetSize())
+		}
+
+		downloaded, err := gw.Download(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to download %s: %v", tt.path, err)
+		}
+		if len(downloaded) != 0 {
+			t.Fatalf("Expected %s to be empty, got %q", tt.path, downloaded)
+		}
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_Pipelined(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	fPath := "/Admin/Pipelined.bin"
+	content := make([]byte, 5<<20)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+
+	file, err := sftp.Create(fPath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	// ReadFrom sends concurrent writes, which may arrive out of order
+	_, err = file.ReadFrom(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close uploaded file: %v", err)
+	}
+
+	downloaded, err := ts.GetGateway("admin").Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download uploaded file: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("Uploaded content does not match original content")
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_Large(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	// Larger than the default TUS threshold, so the upload is sent in chunks
+	fPath := "/Admin/Large.bin"
+	content := make([]byte, 40<<20)
+	for i := range content {
+		content[i] = byte(i % 241)
+	}
+
+	file, err := sftp.Create(fPath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	_, err = file.ReadFrom(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close uploaded file: %v", err)
+	}
+
+	res, err := ts.GetGateway("admin").Stat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to stat uploaded file: %v", err)
+	}
+
+	if res.GetSize() != uint64(len(content)) {
+		t.Fatalf("Expected uploaded file size %d, got %d", len(content), res.GetSize())
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_Resume(t *testing.T) {
+	fPath := "/Admin/Resume.bin"
+	content := make([]byte, 2<<20)
+	for i := range content {
+		content[i] = byte(i % 239)
+	}
+	half := int64(len(content) / 2)
+
+	// Interrupt the first upload by dropping the connection with the handle still open
+	interrupted, err := ts.sftpClientFactory.NewClient("admin")
+	if err != nil {
+		t.Fatalf("Failed to create SFTP client: %v", err)
+	}
+
+	file, err := interrupted.Create(fPath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	_, err = file.Write(content[:half])
+	if err != nil {
+		t.Fatalf("Failed to upload first half: %v", err)
+	}
+
+	_ = interrupted.SSHClient.Close()
+
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	// The server may need a moment to notice the dropped connection
+	var fi os.FileInfo
+	for i := 0; i < 50; i++ {
+		if fi, err = sftp.Stat(fPath); err == nil && fi.Size() == half {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if fi == nil || fi.Size() != half {
+		t.Fatalf("Expected interrupted upload to report size %d, got %v", half, fi)
+	}
+
+	// lstat and listings show the stored size, which matches what is read from the file
+	fi, err = sftp.Lstat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to lstat file: %v", err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("Expected lstat to report the stored size 0, got %d", fi.Size())
+	}
+
+	files, err := sftp.ReadDir("/Admin")
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+	for _, f := range files {
+		if f.Name() == "Resume.bin" && f.Size() != 0 {
+			t.Fatalf("Expected listing to report the stored size 0, got %d", f.Size())
+		}
+	}
+
+	// Resume like "reput" does, appending from the reported size with several writes in flight
+	file, err = sftp.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("Failed to open file for resuming: %v", err)
+	}
+
+	err = writeConcurrently(file, content[half:], half)
+	if err != nil {
+		t.Fatalf("Failed to upload second half: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close resumed file: %v", err)
+	}
+
+	downloaded, err := ts.GetGateway("admin").Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download resumed file: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("Resumed content does not match original content")
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_NoPartialContent(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	fPath := "/Admin/Replaced.txt"
+	oldContent := []byte("old content")
+
+	err := gw.CreateFile(fPath, oldContent)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	file, err := sftp.Create(fPath)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	_, err = file.Write([]byte("new "))
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Other clients keep seeing the old content while the upload is in progress
+	downloaded, err := gw.Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, oldContent) {
+		t.Fatalf("Expected content %q during upload, got %q", oldContent, downloaded)
+	}
+
+	_, err = file.Write([]byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+
+	downloaded, err = gw.Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+
+	if string(downloaded) != "new content" {
+		t.Fatalf("Expected content %q after upload, got %q", "new content", downloaded)
+	}
+
+	entries, err := sftp.ReadDir("/Admin")
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+
+	// the public key of the test user is kept in .ssh
+	for _, e := range entries {
+		if e.Name() != "Replaced.txt" && e.Name() != ".ssh" {
+			t.Fatalf("Unexpected entry %q left behind by upload", e.Name())
+		}
+	}
+}
+
+func (ts *TestSuite) TestUploadFile_Atomic(t *testing.T) {
+	sftp, cleanup := ts.GetAtomicSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	fPath := "/Admin/Atomic.txt"
+
+	err := gw.CreateFile(fPath, []byte("first"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	before, err := gw.Stat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	// overwriting an existing file replaces its content, a new file is moved into place
+	uploads := []struct {
+		path    string
+		content string
+	}{
+		{fPath, "second"},
+		{fPath, "third"},
+		{"/Admin/AtomicNew.txt", "new"},
+	}
+
+	for _, u := range uploads {
+		file, err := sftp.Create(u.path)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", u.path, err)
+		}
+		if _, err := file.Write([]byte(u.content)); err != nil {
+			t.Fatalf("Failed to write %s: %v", u.path, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close %s: %v", u.path, err)
+		}
+
+		downloaded, err := gw.Download(u.path)
+		if err != nil {
+			t.Fatalf("Failed to download %s: %v", u.path, err)
+		}
+		if string(downloaded) != u.content {
+			t.Fatalf("Expected content %q in %s, got %q", u.content, u.path, downloaded)
+		}
+	}
+
+	// the overwritten file is still the same resource, with a version for each replaced content
+	after, err := gw.Stat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if after.GetId().GetOpaqueId() != before.GetId().GetOpaqueId() {
+		t.Fatalf("Expected file id %s to be kept, got %s", before.GetId().GetOpaqueId(), after.GetId().GetOpaqueId())
+	}
+
+	versions, err := sftp.ReadDir("/Admin/.versions/Atomic.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(versions))
+	}
+
+	entries, err := sftp.ReadDir("/Admin")
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != "Atomic.txt" && e.Name() != "AtomicNew.txt" && e.Name() != ".ssh" {
+			t.Fatalf("Unexpected entry %q left behind by upload", e.Name())
+		}
+	}
+}
+
+func (ts *TestSuite) TestDownloadFile_Sequential(t *testing.T) {
+	fPath := "/Admin/Sequential.bin"
+	content := make([]byte, 12<<20+321)
+	for i := range content {
+		content[i] = byte(i % 247)
+	}
+
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile(fPath, content)
+	if err != nil {
+		t.Fatalf("Failed to create file for download: %v", err)
+	}
+
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	file, err := sftp.Open(fPath)
+	if err != nil {
+		t.Fatalf("Failed to open file for download: %v", err)
+	}
+	defer file.Close()
+
+	// WriteTo sends concurrent reads, which the server serves from its read-ahead
+	var downloaded bytes.Buffer
+	_, err = file.WriteTo(&downloaded)
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatalf("Downloaded content does not match original content")
+	}
+}
+
+func (ts *TestSuite) TestOpenFile_Flags(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	fPath := "/Admin/Flags.txt"
+
+	err := gw.CreateFile(fPath, []byte("line 1\n"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	// Exclusive creation fails if the file exists
+	_, err = sftp.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err == nil {
+		t.Fatalf("Expected exclusive creation of existing file to fail")
+	}
+
+	// Opening a missing file without the create flag fails
+	_, err = sftp.OpenFile("/Admin/Missing.txt", os.O_WRONLY)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected opening a missing file to fail with not exist, got %v", err)
+	}
+
+	// Append writes at the end, an offset within the existing content is ignored
+	file, err := sftp.OpenFile(fPath, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("Failed to open file for appending: %v", err)
+	}
+
+	_, err = file.WriteAt([]byte("line 2\n"), 0)
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+
+	downloaded, err := gw.Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+
+	if string(downloaded) != "line 1\nline 2\n" {
+		t.Fatalf("Unexpected content after append: %q", downloaded)
+	}
+
+	// Truncation empties the file, even if nothing is written
+	file, err = sftp.OpenFile(fPath, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatalf("Failed to open file for truncation: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+
+	fi, err := sftp.Stat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	if fi.Size() != 0 {
+		t.Fatalf("Expected truncated file to be empty, got size %d", fi.Size())
+	}
+
+	// Exclusive creation of a missing file succeeds
+	file, err = sftp.OpenFile("/Admin/Lock.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		t.Fatalf("Failed to create file exclusively: %v", err)
+	}
+	_ = file.Close()
+}
+
+func (ts *TestSuite) TestOpenFile_AppendPipelined(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	prefix := []byte("line 1\n")
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	err := gw.CreateFile("/Admin/AppendExisting.bin", prefix)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		flags int
+		start []byte
+	}{
+		{"/Admin/AppendExisting.bin", os.O_WRONLY | os.O_APPEND, prefix},
+		{"/Admin/AppendNew.bin", os.O_WRONLY | os.O_CREATE | os.O_APPEND, nil},
+	}
+
+	for _, tt := range tests {
+		file, err := sftp.OpenFile(tt.path, tt.flags)
+		if err != nil {
+			t.Fatalf("Failed to open %s for appending: %v", tt.path, err)
+		}
+
+		// the writes carry the offsets past the existing content and may be handled in any order
+		err = writeConcurrently(file, content, int64(len(tt.start)))
+		if err != nil {
+			t.Fatalf("Failed to append to %s: %v", tt.path, err)
+		}
+
+		err = file.Close()
+		if err != nil {
+			t.Fatalf("Failed to close %s: %v", tt.path, err)
+		}
+
+		downloaded, err := gw.Download(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to download %s: %v", tt.path, err)
+		}
+
+		if !bytes.Equal(downloaded, append(append([]byte{}, tt.start...), content...)) {
+			t.Fatalf("Appended content of %s does not match, got %d bytes", tt.path, len(downloaded))
+		}
+	}
+}
+
+// writeConcurrently writes data to file at off in chunks which are all in flight at the same time
+func writeConcurrently(file *pkgsftp.File, data []byte, off int64) error {
+	const chunkSize = 32 << 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(data)/chunkSize+1)
+	for start := 0; start < len(data); start += chunkSize {
+		chunk := data[start:min(start+chunkSize, len(data))]
+
+		wg.Add(1)
+		go func(chunk []byte, off int64) {
+			defer wg.Done()
+			if _, err := file.WriteAt(chunk, off); err != nil {
+				errs <- err
+			}
+		}(chunk, off+int64(start))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+func (ts *TestSuite) TestSetstat(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	fPath := "/Admin/Setstat.txt"
+
+	err := gw.CreateFile(fPath, []byte("Hello, World!"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = sftp.Chtimes(fPath, mtime, mtime)
+	if err != nil {
+		t.Fatalf("Failed to set times: %v", err)
+	}
+
+	err = sftp.Truncate(fPath, 5)
+	if err != nil {
+		t.Fatalf("Failed to truncate file: %v", err)
+	}
+
+	// Permission and ownership changes are accepted without effect
+	err = sftp.Chmod(fPath, 0600)
+	if err != nil {
+		t.Fatalf("Failed to change permissions: %v", err)
+	}
+
+	err = sftp.Chown(fPath, 1000, 1000)
+	if err != nil {
+		t.Fatalf("Failed to change ownership: %v", err)
+	}
+
+	downloaded, err := gw.Download(fPath)
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+
+	if string(downloaded) != "Hello" {
+		t.Fatalf("Unexpected content after truncation: %q", downloaded)
+	}
+
+	// growing a file pads it with zeros, emptying it drops the content
+	sizes := []struct {
+		size int64
+		want string
+	}{
+		{8, "Hello\x00\x00\x00"},
+		{0, ""},
+	}
+
+	for _, tt := range sizes {
+		if err := sftp.Truncate(fPath, tt.size); err != nil {
+			t.Fatalf("Failed to truncate file to %d bytes: %v", tt.size, err)
+		}
+
+		downloaded, err := gw.Download(fPath)
+		if err != nil {
+			t.Fatalf("Failed to download file: %v", err)
+		}
+
+		if string(downloaded) != tt.want {
+			t.Fatalf("Unexpected content after truncation to %d bytes: %q", tt.size, downloaded)
+		}
+	}
+
+	// Changes while the file is open are applied to the written content
+	file, err := sftp.OpenFile(fPath, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	_, err = file.Write([]byte("Preserved content"))
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	err = file.Truncate(int64(len("Preserved")))
+	if err != nil {
+		t.Fatalf("Failed to truncate through handle: %v", err)
+	}
+
+	err = sftp.Chtimes(fPath, mtime, mtime)
+	if err != nil {
+		t.Fatalf("Failed to set times of open file: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+
+	fi, err := sftp.Stat(fPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("Expected mtime %v, got %v", mtime, fi.ModTime())
+	}
+
+	if fi.Size() != int64(len("Preserved")) {
+		t.Fatalf("Expected size %d, got %d", len("Preserved"), fi.Size())
+	}
+}
+
+func (ts *TestSuite) TestStatVFS(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	content := bytes.Repeat([]byte("x"), 1<<20)
+
+	err := gw.CreateFile("/Admin/Quota.bin", content)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	for _, p := range []string{"/", "/Admin", "/Admin/Quota.bin"} {
+		stat, err := sftp.StatVFS(p)
+		if err != nil {
+			t.Fatalf("Failed to statvfs %s: %v", p, err)
+		}
+
+		if stat.Bsize == 0 || stat.Blocks == 0 {
+			t.Fatalf("Expected a non-empty file system for %s, got %+v", p, stat)
+		}
+
+		if stat.Bfree > stat.Blocks || stat.Bavail > stat.Bfree {
+			t.Fatalf("Inconsistent free blocks for %s: %+v", p, stat)
+		}
+
+		if stat.TotalSpace()-stat.FreeSpace() < uint64(len(content)) {
+			t.Fatalf("Expected at least %d used bytes for %s, got %d", len(content), p, stat.TotalSpace()-stat.FreeSpace())
+		}
+	}
+
+	_, err = sftp.StatVFS("/Missing")
+	if err == nil {
+		t.Fatalf("Expected statvfs of a missing space to fail")
+	}
+}
+
+func (ts *TestSuite) TestRename_CrossSpace(t *testing.T) {
+	sftp, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+
+	err := gw.CreateProjectSpace("Project Move")
+	if err != nil {
+		t.Fatalf("Failed to create project space: %v", err)
+	}
+	defer func() {
+		_ = gw.DeleteProjectSpace("Project Move")
+	}()
+
+	for _, dir := range []string{"/Admin/Tree", "/Admin/Tree/Nested"} {
+		err = gw.CreateFolder(dir)
+		if err != nil {
+			t.Fatalf("Failed to create folder: %v", err)
+		}
+	}
+
+	err = gw.CreateFile("/Admin/Tree/Nested/File.txt", []byte("Hello, World!"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	err = sftp.Rename("/Admin/Tree", "/Project Move/Tree")
+	if err != nil {
+		t.Fatalf("Failed to move folder across spaces: %v", err)
+	}
+
+	downloaded, err := gw.Download("/Project Move/Tree/Nested/File.txt")
+	if err != nil {
+		t.Fatalf("Failed to download moved file: %v", err)
+	}
+
+	if string(downloaded) != "Hello, World!" {
+		t.Fatalf("Unexpected content of moved file: %q", downloaded)
+	}
+
+	_, err = sftp.Stat("/Admin/Tree")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected source to be gone, got %v", err)
+	}
+
+	// Rename does not replace an existing target, POSIX rename does
+	err = gw.CreateFile("/Admin/Replace.txt", []byte("new"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	err = gw.CreateFile("/Project Move/Replace.txt", []byte("old"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	err = sftp.Rename("/Admin/Replace.txt", "/Project Move/Replace.txt")
+	if err == nil {
+		t.Fatalf("Expected rename onto an existing file to fail")
+	}
+
+	before, err := gw.Stat("/Project Move/Replace.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	err = sftp.PosixRename("/Admin/Replace.txt", "/Project Move/Replace.txt")
+	if err != nil {
+		t.Fatalf("Failed to replace file across spaces: %v", err)
+	}
+
+	downloaded, err = gw.Download("/Project Move/Replace.txt")
+	if err != nil {
+		t.Fatalf("Failed to download replaced file: %v", err)
+	}
+
+	if string(downloaded) != "new" {
+		t.Fatalf("Unexpected content of replaced file: %q", downloaded)
+	}
+
+	_, err = sftp.Stat("/Admin/Replace.txt")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected source to be gone, got %v", err)
+	}
+
+	// the replaced file is still the same resource, the old content is kept as a version
+	after, err := gw.Stat("/Project Move/Replace.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if after.GetId().GetOpaqueId() != before.GetId().GetOpaqueId() {
+		t.Fatalf("Expected file id %s to be kept, got %s", before.GetId().GetOpaqueId(), after.GetId().GetOpaqueId())
+	}
+
+	versions, err := sftp.ReadDir("/Project Move/.versions/Replace.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("Expected 1 version, got %d", len(versions))
+	}
+}
+
+func (ts *TestSuite) TestCopyData(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	content := bytes.Repeat([]byte("0123456789"), 300000)
+
+	err := gw.CreateFile("/Admin/CopySource.bin", content)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	raw, err := client.NewRawSession()
+	if err != nil {
+		t.Fatalf("Failed to start raw session: %v", err)
+	}
+	defer raw.Close()
+
+	for _, ext := range []string{"copy-data", "copy-file"} {
+		if _, ok := raw.Extensions[ext]; !ok {
+			t.Fatalf("Expected extension %s to be advertised, got %v", ext, raw.Extensions)
+		}
+	}
+
+	src, err := raw.Open("/Admin/CopySource.bin", sftp.FxfRead)
+	if err != nil {
+		t.Fatalf("Failed to open source: %v", err)
+	}
+
+	dst, err := raw.Open("/Admin/CopyTarget.bin", sftp.FxfWrite|sftp.FxfCreat|sftp.FxfTrunc)
+	if err != nil {
+		t.Fatalf("Failed to open target: %v", err)
+	}
+
+	// a length of zero copies the whole file
+	_, err = raw.Extended("copy-data", src, uint64(0), uint64(0), dst, uint64(0))
+	if err != nil {
+		t.Fatalf("Failed to copy data: %v", err)
+	}
+
+	// ranges are copied to the given offset
+	_, err = raw.Extended("copy-data", src, uint64(10), uint64(5), dst, uint64(len(content)))
+	if err != nil {
+		t.Fatalf("Failed to copy range: %v", err)
+	}
+
+	for _, h := range []string{src, dst} {
+		if err := raw.CloseHandle(h); err != nil {
+			t.Fatalf("Failed to close handle: %v", err)
+		}
+	}
+
+	downloaded, err := gw.Download("/Admin/CopyTarget.bin")
+	if err != nil {
+		t.Fatalf("Failed to download copy: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, append(content, "01234"...)) {
+		t.Fatalf("Copied content does not match, got %d bytes", len(downloaded))
+	}
+
+	// copy-file does not replace the target unless asked to
+	_, err = raw.Extended("copy-file", "/Admin/CopySource.bin", "/Admin/CopyTarget.bin", false)
+	if err == nil {
+		t.Fatalf("Expected copy-file onto an existing file to fail")
+	}
+
+	_, err = raw.Extended("copy-file", "/Admin/CopySource.bin", "/Admin/CopyTarget.bin", true)
+	if err != nil {
+		t.Fatalf("Failed to copy file: %v", err)
+	}
+
+	downloaded, err = gw.Download("/Admin/CopyTarget.bin")
+	if err != nil {
+		t.Fatalf("Failed to download copy: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("Copied file does not match, got %d bytes", len(downloaded))
+	}
+
+	// an existing file with other content is replaced, and stays the same resource
+	err = gw.CreateFile("/Admin/CopyReplace.txt", []byte("old"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	before, err := gw.Stat("/Admin/CopyReplace.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	_, err = raw.Extended("copy-file", "/Admin/CopySource.bin", "/Admin/CopyReplace.txt", true)
+	if err != nil {
+		t.Fatalf("Failed to copy onto an existing file: %v", err)
+	}
+
+	downloaded, err = gw.Download("/Admin/CopyReplace.txt")
+	if err != nil {
+		t.Fatalf("Failed to download copy: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("Replaced file does not match, got %d bytes", len(downloaded))
+	}
+
+	after, err := gw.Stat("/Admin/CopyReplace.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if after.GetId().GetOpaqueId() != before.GetId().GetOpaqueId() {
+		t.Fatalf("Expected file id %s to be kept, got %s", before.GetId().GetOpaqueId(), after.GetId().GetOpaqueId())
+	}
+
+	// with a path open twice, the data goes to the handle it is copied to
+	src, err = raw.Open("/Admin/CopySource.bin", sftp.FxfRead)
+	if err != nil {
+		t.Fatalf("Failed to open source: %v", err)
+	}
+	first, err := raw.Open("/Admin/CopyTwice.bin", sftp.FxfWrite|sftp.FxfCreat|sftp.FxfTrunc)
+	if err != nil {
+		t.Fatalf("Failed to open target: %v", err)
+	}
+	second, err := raw.Open("/Admin/CopyTwice.bin", sftp.FxfWrite)
+	if err != nil {
+		t.Fatalf("Failed to open target again: %v", err)
+	}
+
+	_, err = raw.Extended("copy-data", src, uint64(0), uint64(0), first, uint64(0))
+	if err != nil {
+		t.Fatalf("Failed to copy data: %v", err)
+	}
+
+	// the unchanged second handle is closed first, the first one stores the copy
+	for _, h := range []string{src, second, first} {
+		if err := raw.CloseHandle(h); err != nil {
+			t.Fatalf("Failed to close handle: %v", err)
+		}
+	}
+
+	downloaded, err = gw.Download("/Admin/CopyTwice.bin")
+	if err != nil {
+		t.Fatalf("Failed to download copy: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("Copied content does not match, got %d bytes", len(downloaded))
+	}
+}
+
+func (ts *TestSuite) TestCheckFile(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+
+	err := gw.CreateFile("/Admin/Checksum.bin", content)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	raw, err := client.NewRawSession()
+	if err != nil {
+		t.Fatalf("Failed to start raw session: %v", err)
+	}
+	defer raw.Close()
+
+	for _, ext := range []string{"check-file-name", "check-file-handle"} {
+		if _, ok := raw.Extensions[ext]; !ok {
+			t.Fatalf("Expected extension %s to be advertised, got %v", ext, raw.Extensions)
+		}
+	}
+
+	sha := sha1.Sum(content)
+	md := md5.Sum(content)
+	tests := []struct {
+		name       string
+		algorithms string
+		offset     uint64
+		length     uint64
+		blockSize  uint32
+		algo       string
+		want       []byte
+	}{
+		{"whole file", "sha1,md5", 0, 0, 0, "sha1", sha[:]},
+		{"first supported algorithm", "sha256,md5", 0, 0, 0, "md5", md[:]},
+		{"adler32", "adler32", 0, 0, 0, "adler32", binary.BigEndian.AppendUint32(nil, adler32.Checksum(content))},
+		{"range", "md5", 10, 1000, 0, "md5", md5Sums(content[10:1010], 0)},
+		{"blocks", "md5", 0, 0, 300000, "md5", md5Sums(content, 300000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := raw.Extended("check-file-name", "/Admin/Checksum.bin", tt.algorithms, tt.offset, tt.length, tt.blockSize)
+			if err != nil {
+				t.Fatalf("Failed to check file: %v", err)
+			}
+
+			want := binary.BigEndian.AppendUint32(nil, uint32(len("check-file")))
+			want = append(want, "check-file"...)
+			want = binary.BigEndian.AppendUint32(want, uint32(len(tt.algo)))
+			want = append(want, tt.algo...)
+			want = append(want, tt.want...)
+
+			if !bytes.Equal(reply, want) {
+				t.Fatalf("Expected reply %x, got %x", want, reply)
+			}
+		})
+	}
+
+	// files being written are hashed from what has been written so far
+	handle, err := raw.Open("/Admin/ChecksumWrite.bin", sftp.FxfWrite|sftp.FxfCreat|sftp.FxfTrunc)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer raw.CloseHandle(handle)
+
+	reply, err := raw.Extended("check-file-handle", handle, "md5", uint64(0), uint64(0), uint32(0))
+	if err != nil {
+		t.Fatalf("Failed to check handle: %v", err)
+	}
+
+	empty := md5.Sum(nil)
+	if !bytes.HasSuffix(reply, empty[:]) {
+		t.Fatalf("Expected hash of empty file, got %x", reply)
+	}
+
+	_, err = raw.Extended("check-file-name", "/Admin/Checksum.bin", "crc32", uint64(0), uint64(0), uint32(0))
+	if err == nil {
+		t.Fatalf("Expected unsupported algorithm to fail")
+	}
+}
+
+// md5Sums returns the concatenated md5 sums of content in blocks of blockSize bytes, or of the whole content
+func md5Sums(content []byte, blockSize int) []byte {
+	if blockSize == 0 {
+		blockSize = len(content)
+	}
+
+	var sums []byte
+	for off := 0; off < len(content); off += blockSize {
+		sum := md5.Sum(content[off:min(off+blockSize, len(content))])
+		sums = append(sums, sum[:]...)
+	}
+	return sums
+}
+
+func (ts *TestSuite) TestExecHashCommands(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	content := []byte("hash me")
+
+	err := gw.CreateFile("/Admin/Hash me.txt", content)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	md := md5.Sum(content)
+	sha := sha1.Sum(content)
+	abc := md5.Sum([]byte("abc\n"))
+
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"md5sum", `md5sum "/Admin/Hash me.txt"`, fmt.Sprintf("%x  /Admin/Hash me.txt\n", md)},
+		{"sha1sum", `sha1sum '/Admin/Hash me.txt'`, fmt.Sprintf("%x  /Admin/Hash me.txt\n", sha)},
+		{"piped echo", `echo 'abc' | md5sum`, fmt.Sprintf("%x  -\n", abc)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, err := client.Run(tt.command)
+			if err != nil {
+				t.Fatalf("Failed to run %s: %v, %s", tt.command, err, stderr)
+			}
+
+			if stdout != tt.want {
+				t.Fatalf("Expected output %q, got %q", tt.want, stdout)
+			}
+		})
+	}
+
+	_, stderr, err := client.Run(`md5sum /Admin/Missing.txt`)
+	if err == nil {
+		t.Fatalf("Expected md5sum of a missing file to fail")
+	}
+	if stderr != "md5sum: /Admin/Missing.txt: No such file or directory\n" {
+		t.Fatalf("Unexpected error output %q", stderr)
+	}
+
+	_, _, err = client.Run(`rm -rf /Admin`)
+	if err == nil {
+		t.Fatalf("Expected other commands to be refused")
+	}
+}
+
+func (ts *TestSuite) TestSCP(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFolder("/Admin/SCP")
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+
+	// upload a directory tree with times, as "scp -r -p" does
+	sess, stdin, stdout, err := client.Exec("scp -r -p -t /Admin/SCP")
+	if err != nil {
+		t.Fatalf("Failed to start scp: %v", err)
+	}
+
+	expectAck := func() {
+		t.Helper()
+		var ack [1]byte
+		if _, err := io.ReadFull(stdout, ack[:]); err != nil {
+			t.Fatalf("Failed to read ack: %v", err)
+		}
+		if ack[0] != 0 {
+			t.Fatalf("Expected ack, got %d", ack[0])
+		}
+	}
+
+	send := func(msg string) {
+		t.Helper()
+		if _, err := io.WriteString(stdin, msg); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expectAck()
+	send("D0755 0 tree\n")
+	expectAck()
+	send(fmt.Sprintf("T%d 0 %d 0\n", mtime.Unix(), mtime.Unix()))
+	expectAck()
+	send("C0644 11 hello world\n")
+	expectAck()
+	send("hello scp!\n\x00")
+	expectAck()
+	send("E\n")
+	expectAck()
+	stdin.Close()
+
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("scp upload failed: %v", err)
+	}
+
+	downloaded, err := gw.Download("/Admin/SCP/tree/hello world")
+	if err != nil {
+		t.Fatalf("Failed to download uploaded file: %v", err)
+	}
+	if string(downloaded) != "hello scp!\n" {
+		t.Fatalf("Unexpected content %q", downloaded)
+	}
+
+	info, err := client.Stat("/Admin/SCP/tree/hello world")
+	if err != nil {
+		t.Fatalf("Failed to stat uploaded file: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("Expected mtime %v, got %v", mtime, info.ModTime())
+	}
+
+	// download it again, as "scp -r" does
+	sess, stdin, stdout, err = client.Exec("scp -r -f /Admin/SCP/tree")
+	if err != nil {
+		t.Fatalf("Failed to start scp: %v", err)
+	}
+
+	send("\x00")
+	r := bufio.NewReader(stdout)
+	for _, want := range []string{"D0755 0 tree\n", "C0644 11 hello world\n", "hello scp!\n\x00", "E\n"} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("Failed to read %q: %v", want, err)
+		}
+		if string(got) != want {
+			t.Fatalf("Expected %q, got %q", want, got)
+		}
+		send("\x00")
+	}
+	stdin.Close()
+
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("scp download failed: %v", err)
+	}
+}
+
+func (ts *TestSuite) TestHomeDirectory(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile("/Admin/InHome.txt", []byte("home"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	// sessions start in the personal space
+	wd, err := client.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if wd != "/Admin" {
+		t.Fatalf("Expected working directory /Admin, got %s", wd)
+	}
+
+	// relative paths resolve against it
+	info, err := client.Stat("InHome.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat relative path: %v", err)
+	}
+	if info.Size() != 4 {
+		t.Fatalf("Expected size 4, got %d", info.Size())
+	}
+
+	realPath, err := client.RealPath("sub/../InHome.txt")
+	if err != nil {
+		t.Fatalf("Failed to resolve path: %v", err)
+	}
+	if realPath != "/Admin/InHome.txt" {
+		t.Fatalf("Expected /Admin/InHome.txt, got %s", realPath)
+	}
+
+	raw, err := client.NewRawSession()
+	if err != nil {
+		t.Fatalf("Failed to start raw session: %v", err)
+	}
+	defer raw.Close()
+
+	tests := []struct {
+		extension string
+		arg       string
+		want      string
+	}{
+		{"expand-path@openssh.com", "~", "/Admin"},
+		{"expand-path@openssh.com", "~/InHome.txt", "/Admin/InHome.txt"},
+		{"expand-path@openssh.com", "~admin/InHome.txt", "/Admin/InHome.txt"},
+		{"expand-path@openssh.com", "/Shares", "/Shares"},
+		{"home-directory", "", "/Admin"},
+		{"home-directory", "admin", "/Admin"},
+	}
+
+	for _, tt := range tests {
+		got, err := raw.Name(tt.extension, tt.arg)
+		if err != nil {
+			t.Fatalf("%s %q failed: %v", tt.extension, tt.arg, err)
+		}
+		if got != tt.want {
+			t.Fatalf("%s %q: expected %s, got %s", tt.extension, tt.arg, tt.want, got)
+		}
+	}
+
+	if _, err := raw.Name("home-directory", "someone-else"); err == nil {
+		t.Fatalf("Expected home-directory of another user to fail")
+	}
+}
+
+func (ts *TestSuite) TestLayout_UniqueNames(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+
+	// two projects with the same name, and one named like the shares
+	for _, name := range []string{"Twin", "Twin", "Shares"} {
+		if err := gw.CreateProjectSpace(name); err != nil {
+			t.Fatalf("Failed to create project space: %v", err)
+		}
+	}
+	defer func() {
+		_ = gw.DeleteProjectSpace("Twin")
+		_ = gw.DeleteProjectSpace("Shares")
+		_ = gw.DeleteProjectSpace("Disabled Project")
+	}()
+
+	if err := gw.CreateProjectSpace("Disabled Project"); err != nil {
+		t.Fatalf("Failed to create project space: %v", err)
+	}
+	if err := gw.DisableProjectSpace("Disabled Project"); err != nil {
+		t.Fatalf("Failed to disable project space: %v", err)
+	}
+
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list root directory: %v", err)
+	}
+
+	names := map[string]int{}
+	twins := 0
+	for _, f := range files {
+		names[f.Name()]++
+		if strings.HasPrefix(f.Name(), "Twin (") {
+			twins++
+		}
+	}
+
+	for name, n := range names {
+		if n > 1 {
+			t.Fatalf("Expected unique names, %s is listed %d times", name, n)
+		}
+	}
+
+	if twins != 2 || names["Twin"] != 0 {
+		t.Fatalf("Expected both projects named Twin to get their id appended, got %v", names)
+	}
+
+	// the shares keep their name, the project named like them is told apart
+	assert.DirExists(t, files, "Shares")
+	assert.DirExists(t, files, "Admin")
+
+	if names["Disabled Project"] != 0 {
+		t.Fatalf("Expected disabled spaces to be hidden, got %v", names)
+	}
+
+	// the disambiguated names are stable and can be used in paths
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "Twin (") {
+			continue
+		}
+
+		if err := client.Mkdir("/" + f.Name() + "/Dir"); err != nil {
+			t.Fatalf("Failed to create directory in %s: %v", f.Name(), err)
+		}
+	}
+}
+
+func (ts *TestSuite) TestTrash(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile("/Admin/Trashed.txt", []byte("trashed"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = gw.CreateFolder("/Admin/TrashedDir")
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	err = gw.CreateFile("/Admin/TrashedDir/Inner.txt", []byte("inner"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	if err := client.Remove("/Admin/Trashed.txt"); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if err := client.RemoveAll("/Admin/TrashedDir"); err != nil {
+		t.Fatalf("Failed to delete folder: %v", err)
+	}
+
+	// the trash is not listed in the space, so that it is not mirrored along with it
+	files, err := client.ReadDir("/Admin")
+	if err != nil {
+		t.Fatalf("Failed to list space: %v", err)
+	}
+	for _, f := range files {
+		if f.Name() == ".trash" {
+			t.Fatalf("Expected .trash to be hidden in the space root")
+		}
+	}
+
+	items, err := client.ReadDir("/Admin/.trash")
+	if err != nil {
+		t.Fatalf("Failed to list trash: %v", err)
+	}
+
+	var file, dir string
+	for _, item := range items {
+		switch {
+		case strings.HasPrefix(item.Name(), "Trashed.txt~"):
+			file = item.Name()
+		case strings.HasPrefix(item.Name(), "TrashedDir~") && item.IsDir():
+			dir = item.Name()
+		}
+	}
+	if file == "" || dir == "" {
+		t.Fatalf("Expected deleted file and folder in the trash, got %v", items)
+	}
+
+	inner, err := client.ReadDir("/Admin/.trash/" + dir)
+	if err != nil {
+		t.Fatalf("Failed to list deleted folder: %v", err)
+	}
+	if len(inner) != 1 || inner[0].Name() != "Inner.txt" {
+		t.Fatalf("Expected Inner.txt in the deleted folder, got %v", inner)
+	}
+
+	// deleted files can be read, at the top of the trash and within deleted folders
+	for name, want := range map[string]string{file: "trashed", dir + "/Inner.txt": "inner"} {
+		f, err := client.Open("/Admin/.trash/" + name)
+		if err != nil {
+			t.Fatalf("Failed to open trash item %s: %v", name, err)
+		}
+		content, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("Failed to read trash item %s: %v", name, err)
+		}
+		if string(content) != want {
+			t.Fatalf("Expected trash item %s to contain %q, got %q", name, want, content)
+		}
+	}
+
+	// reading leaves the items in the trash under the same names, and the original locations empty
+	items, err = client.ReadDir("/Admin/.trash")
+	if err != nil {
+		t.Fatalf("Failed to list trash: %v", err)
+	}
+	assert.FileExists(t, items, file)
+	assert.DirExists(t, items, dir)
+
+	inner, err = client.ReadDir("/Admin/.trash/" + dir)
+	if err != nil {
+		t.Fatalf("Failed to list deleted folder: %v", err)
+	}
+	if len(inner) != 1 || inner[0].Name() != "Inner.txt" {
+		t.Fatalf("Expected Inner.txt in the deleted folder after reading, got %v", inner)
+	}
+
+	for _, p := range []string{"/Admin/Trashed.txt", "/Admin/TrashedDir"} {
+		if _, err := client.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected %s to stay deleted, got %v", p, err)
+		}
+	}
+
+	// items whose original location has been taken can not be read
+	if err := gw.CreateFile("/Admin/Trashed.txt", []byte("new")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := client.Open("/Admin/.trash/" + file); err == nil {
+		t.Fatalf("Expected reading a trash item with a taken original location to fail")
+	}
+	if err := gw.Delete("/Admin/Trashed.txt"); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+
+	// nothing can be written into the trash
+	if _, err := client.Create("/Admin/.trash/New.txt"); err == nil {
+		t.Fatalf("Expected creating a file in the trash to fail")
+	}
+
+	// renaming an item out of the trash restores it
+	if err := client.Rename("/Admin/.trash/"+file, "/Admin/Restored.txt"); err != nil {
+		t.Fatalf("Failed to restore file: %v", err)
+	}
+
+	content, err := gw.Download("/Admin/Restored.txt")
+	if err != nil {
+		t.Fatalf("Failed to download restored file: %v", err)
+	}
+	if string(content) != "trashed" {
+		t.Fatalf("Expected restored content %q, got %q", "trashed", content)
+	}
+
+	if _, err := client.Stat("/Admin/.trash/" + file); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected restored item to leave the trash, got %v", err)
+	}
+
+	// removing an item from the trash purges it
+	if err := client.Remove("/Admin/.trash/" + dir + "/Inner.txt"); err != nil {
+		t.Fatalf("Failed to purge file: %v", err)
+	}
+	if err := client.RemoveDirectory("/Admin/.trash/" + dir); err != nil {
+		t.Fatalf("Failed to purge folder: %v", err)
+	}
+	if _, err := client.Stat("/Admin/.trash/" + dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected purged item to be gone, got %v", err)
+	}
+}
+
+func (ts *TestSuite) TestVersions(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile("/Admin/Versioned.txt", []byte("first"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	// versions are named after their modification time, which has a resolution of a second
+	time.Sleep(1100 * time.Millisecond)
+	err = gw.CreateFile("/Admin/Versioned.txt", []byte("second"))
+	if err != nil {
+		t.Fatalf("Failed to overwrite file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	files, err := client.ReadDir("/Admin/.versions")
+	if err != nil {
+		t.Fatalf("Failed to list versions view: %v", err)
+	}
+	assert.DirExists(t, files, "Versioned.txt")
+
+	versions, err := client.ReadDir("/Admin/.versions/Versioned.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("Expected one version, got %v", versions)
+	}
+	version := "/Admin/.versions/Versioned.txt/" + versions[0].Name()
+
+	f, err := client.Open(version)
+	if err != nil {
+		t.Fatalf("Failed to open version: %v", err)
+	}
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to read version: %v", err)
+	}
+	if string(content) != "first" {
+		t.Fatalf("Expected version content %q, got %q", "first", content)
+	}
+
+	// versions can't be changed, nor moved anywhere but onto their file
+	if _, err := client.Create(version); err == nil {
+		t.Fatalf("Expected writing a version to fail")
+	}
+	if err := client.Rename(version, "/Admin/Elsewhere.txt"); err == nil {
+		t.Fatalf("Expected moving a version elsewhere to fail")
+	}
+
+	// moving a version onto its file restores it
+	if err := client.Rename(version, "/Admin/Versioned.txt"); err != nil {
+		t.Fatalf("Failed to restore version: %v", err)
+	}
+
+	content, err = gw.Download("/Admin/Versioned.txt")
+	if err != nil {
+		t.Fatalf("Failed to download restored file: %v", err)
+	}
+	if string(content) != "first" {
+		t.Fatalf("Expected restored content %q, got %q", "first", content)
+	}
+
+	// a real .versions directory takes the place of the versions view
+	if err := client.Mkdir("/Admin/RealVersions"); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := client.Mkdir("/Admin/RealVersions/.versions"); err != nil {
+		t.Fatalf("Failed to create a .versions folder: %v", err)
+	}
+	if err := client.Mkdir("/Admin/RealVersions/.versions/Nested"); err != nil {
+		t.Fatalf("Failed to create a folder in a .versions folder: %v", err)
+	}
+
+	files, err = client.ReadDir("/Admin/RealVersions/.versions")
+	if err != nil {
+		t.Fatalf("Failed to list .versions folder: %v", err)
+	}
+	assert.DirExists(t, files, "Nested")
+}
+
+func (ts *TestSuite) TestPendingShares(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	// nothing has been shared with admin, so no share is pending
+	info, err := client.Stat("/Shares/.pending")
+	if err != nil {
+		t.Fatalf("Failed to stat pending shares: %v", err)
+	}
+	if !info.IsDir() {
+		t.Fatalf("Expected pending shares to be a directory")
+	}
+
+	pending, err := client.ReadDir("/Shares/.pending")
+	if err != nil {
+		t.Fatalf("Failed to list pending shares: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending shares, got %v", pending)
+	}
+
+	if err := client.Rename("/Shares/.pending/Missing", "/Shares/Missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected accepting a missing share to fail with not found, got %v", err)
+	}
+	if err := client.Mkdir("/Shares/.pending/New"); err == nil {
+		t.Fatalf("Expected creating a directory in pending shares to fail")
+	}
+}
+
+func (ts *TestSuite) TestReceivedShares(t *testing.T) {
+	admin, adminCleanup := ts.GetSFTPClient("admin")
+	defer adminCleanup()
+
+	gw := ts.GetGateway("admin")
+	content := []byte("shared with alan")
+	if err := gw.CreateFile("/Admin/Accepted.txt", content); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := gw.CreateFile("/Admin/Declined.txt", []byte("declined")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	for _, name := range []string{"/Admin/Accepted.txt", "/Admin/Declined.txt"} {
+		if err := gw.ShareWith(name, "alan", false); err != nil {
+			t.Fatalf("Failed to share %s: %v", name, err)
+		}
+	}
+
+	client, cleanup := ts.GetSFTPClient("alan")
+	defer cleanup()
+
+	pending, err := client.ReadDir("/Shares/.pending")
+	if err != nil {
+		t.Fatalf("Failed to list pending shares: %v", err)
+	}
+	assert.FileExists(t, pending, "Accepted.txt")
+	assert.FileExists(t, pending, "Declined.txt")
+
+	// moving a pending share into the shares accepts it
+	if err := client.Rename("/Shares/.pending/Accepted.txt", "/Shares/Accepted.txt"); err != nil {
+		t.Fatalf("Failed to accept share: %v", err)
+	}
+
+	files, err := client.ReadDir("/Shares")
+	if err != nil {
+		t.Fatalf("Failed to list shares: %v", err)
+	}
+	assert.FileExists(t, files, "Accepted.txt")
+
+	f, err := client.Open("/Shares/Accepted.txt")
+	if err != nil {
+		t.Fatalf("Failed to open accepted share: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("Failed to read accepted share: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected accepted share to contain %q, got %q", content, got)
+	}
+
+	// removing a pending share declines it
+	if err := client.Remove("/Shares/.pending/Declined.txt"); err != nil {
+		t.Fatalf("Failed to decline pending share: %v", err)
+	}
+
+	// removing an accepted share declines it as well, even though it is read-only
+	if err := client.Remove("/Shares/Accepted.txt"); err != nil {
+		t.Fatalf("Failed to decline accepted read-only share: %v", err)
+	}
+
+	files, err = client.ReadDir("/Shares")
+	if err != nil {
+		t.Fatalf("Failed to list shares: %v", err)
+	}
+	pending, err = client.ReadDir("/Shares/.pending")
+	if err != nil {
+		t.Fatalf("Failed to list pending shares: %v", err)
+	}
+	for _, f := range append(files, pending...) {
+		if f.Name() == "Accepted.txt" || f.Name() == "Declined.txt" {
+			t.Fatalf("Expected declined share %s to be gone", f.Name())
+		}
+	}
+
+	// the shared resources are kept
+	for _, name := range []string{"/Admin/Accepted.txt", "/Admin/Declined.txt"} {
+		if _, err := admin.Stat(name); err != nil {
+			t.Fatalf("Expected shared file %s to be kept: %v", name, err)
+		}
+	}
+}
+
+// A resource shared with a user directly and through a group is mounted once, removing it declines both shares
+func (ts *TestSuite) TestReceivedShares_SharedTwice(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	groups, err := gw.UserGroups("alan")
+	if err != nil {
+		t.Fatalf("Failed to get groups: %v", err)
+	}
+	if len(groups) == 0 {
+		t.Skip("alan is not a member of a group")
+	}
+
+	const name = "/Admin/SharedTwice.txt"
+	if err := gw.CreateFile(name, []byte("shared twice")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := gw.ShareWith(name, "alan", false); err != nil {
+		t.Fatalf("Failed to share with alan: %v", err)
+	}
+	if err := gw.ShareWithGroup(name, groups[0], false); err != nil {
+		t.Fatalf("Failed to share with group %s: %v", groups[0], err)
+	}
+
+	info, err := gw.Stat(name)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", name, err)
+	}
+	if err := ts.GetGateway("alan").AcceptShares(info.GetId(), "SharedTwice.txt"); err != nil {
+		t.Fatalf("Failed to accept shares: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("alan")
+	defer cleanup()
+
+	files, err := client.ReadDir("/Shares")
+	if err != nil {
+		t.Fatalf("Failed to list shares: %v", err)
+	}
+	assert.FileExists(t, files, "SharedTwice.txt")
+
+	if err := client.Remove("/Shares/SharedTwice.txt"); err != nil {
+		t.Fatalf("Failed to decline share: %v", err)
+	}
+
+	files, err = client.ReadDir("/Shares")
+	if err != nil {
+		t.Fatalf("Failed to list shares: %v", err)
+	}
+	for _, f := range files {
+		if f.Name() == "SharedTwice.txt" {
+			t.Fatalf("Expected both shares of %s to be declined", name)
+		}
+	}
+	if _, err := client.Stat("/Shares/SharedTwice.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the declined share to be gone, got %v", err)
+	}
+}
+
+func (ts *TestSuite) TestProjectSpaces(t *testing.T) {
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	gw := ts.GetGateway("admin")
+	defer func() {
+		_ = gw.DeleteProjectSpace("SFTP Project")
+		_ = gw.DeleteProjectSpace("SFTP Renamed")
+	}()
+
+	// creating a directory in the root creates a project space
+	if err := client.Mkdir("/SFTP Project"); err != nil {
+		t.Fatalf("Failed to create project space: %v", err)
+	}
+
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list root directory: %v", err)
+	}
+	assert.DirExists(t, files, "SFTP Project")
+
+	if err := client.Mkdir("/Missing/Dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected creating a nested directory outside of spaces to fail with not found, got %v", err)
+	}
+
+	// renaming it renames the space
+	if err := client.Rename("/SFTP Project", "/SFTP Renamed"); err != nil {
+		t.Fatalf("Failed to rename project space: %v", err)
+	}
+	if err := client.Rename("/SFTP Renamed", "/Admin"); err == nil {
+		t.Fatalf("Expected renaming a project space onto another space to fail")
+	}
+
+	files, err = client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list root directory: %v", err)
+	}
+	assert.DirExists(t, files, "SFTP Renamed")
+
+	// removing it disables the space, but only once it is empty
+	if err := client.Mkdir("/SFTP Renamed/Content"); err != nil {
+		t.Fatalf("Failed to create directory in project space: %v", err)
+	}
+	if err := client.RemoveDirectory("/SFTP Renamed"); err == nil {
+		t.Fatalf("Expected removing a project space with content to fail")
+	}
+	if err := client.RemoveDirectory("/SFTP Renamed/Content"); err != nil {
+		t.Fatalf("Failed to remove directory in project space: %v", err)
+	}
+	if err := client.RemoveDirectory("/SFTP Renamed"); err != nil {
+		t.Fatalf("Failed to disable project space: %v", err)
+	}
+
+	files, err = client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list root directory: %v", err)
+	}
+	for _, f := range files {
+		if f.Name() == "SFTP Renamed" {
+			t.Fatalf("Expected disabled project space to be hidden")
+		}
+	}
+
+	// the personal space can't be disabled
+	if err := client.RemoveDirectory("/Admin"); err == nil {
+		t.Fatalf("Expected removing the personal space to fail")
+	}
+}
+
+func (ts *TestSuite) TestFileModes(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFolder("/Admin/ModeDir")
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	err = gw.CreateFile("/Admin/ModeDir/Mode.txt", []byte("mode"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	// modes follow the permissions of the user, who may do anything in the personal space
+	tests := []struct {
+		path string
+		want os.FileMode
+	}{
+		{"/Admin/ModeDir", os.ModeDir | 0755},
+		{"/Admin/ModeDir/Mode.txt", 0644},
+	}
+
+	for _, tt := range tests {
+		info, err := client.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", tt.path, err)
+		}
+		if info.Mode() != tt.want {
+			t.Fatalf("Expected mode %v for %s, got %v", tt.want, tt.path, info.Mode())
+		}
+	}
+}
+
+func (ts *TestSuite) TestFileModes_ReadOnly(t *testing.T) {
+	_, adminCleanup := ts.GetSFTPClient("admin")
+	defer adminCleanup()
+
+	gw := ts.GetGateway("admin")
+	if err := gw.CreateFolder("/Admin/ReadOnly"); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := gw.CreateFile("/Admin/ReadOnly/File.txt", []byte("read-only")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := gw.ShareWith("/Admin/ReadOnly", "alan", false); err != nil {
+		t.Fatalf("Failed to share folder: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("alan")
+	defer cleanup()
+
+	if err := client.Rename("/Shares/.pending/ReadOnly", "/Shares/ReadOnly"); err != nil {
+		t.Fatalf("Failed to accept share: %v", err)
+	}
+	defer func() {
+		_ = client.Remove("/Shares/ReadOnly")
+	}()
+
+	// a viewer may read and list, but not write
+	modes := []struct {
+		path string
+		want os.FileMode
+	}{
+		{"/Shares/ReadOnly", os.ModeDir | 0555},
+		{"/Shares/ReadOnly/File.txt", 0444},
+	}
+	for _, tt := range modes {
+		info, err := client.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", tt.path, err)
+		}
+		if info.Mode() != tt.want {
+			t.Fatalf("Expected mode %v for %s, got %v", tt.want, tt.path, info.Mode())
+		}
+	}
+
+	const file = "/Shares/ReadOnly/File.txt"
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"open for writing", func() error {
+			f, err := client.OpenFile(file, os.O_WRONLY)
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"create", func() error {
+			f, err := client.Create("/Shares/ReadOnly/New.txt")
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"truncate", func() error { return client.Truncate(file, 0) }},
+		{"change times", func() error { return client.Chtimes(file, time.Now(), time.Now()) }},
+		{"remove", func() error { return client.Remove(file) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op()
+			var statusErr *pkgsftp.StatusError
+			if !errors.As(err, &statusErr) || statusErr.FxCode() != pkgsftp.ErrSSHFxPermissionDenied {
+				t.Fatalf("Expected permission denied, got %v", err)
+			}
+		})
+	}
+
+	content, err := gw.Download("/Admin/ReadOnly/File.txt")
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+	if string(content) != "read-only" {
+		t.Fatalf("Expected the shared file to be unchanged, got %q", content)
+	}
+}
+
+func (ts *TestSuite) TestOwners(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFile("/Admin/Owned.txt", []byte("owned"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	info, err := client.Stat("/Admin/Owned.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	stat, ok := info.Sys().(*pkgsftp.FileStat)
+	if !ok {
+		t.Fatalf("Expected file stat, got %T", info.Sys())
+	}
+	if stat.UID == 0 || stat.GID == 0 {
+		t.Fatalf("Expected the file to be owned by the user, got uid %d gid %d", stat.UID, stat.GID)
+	}
+
+	// the ids are stable
+	again, err := client.Stat("/Admin/Owned.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if again.Sys().(*pkgsftp.FileStat).UID != stat.UID {
+		t.Fatalf("Expected uid %d, got %d", stat.UID, again.Sys().(*pkgsftp.FileStat).UID)
+	}
+
+	raw, err := client.NewRawSession()
+	if err != nil {
+		t.Fatalf("Failed to start raw session: %v", err)
+	}
+	defer raw.Close()
+
+	if _, ok := raw.Extensions["users-groups-by-id@openssh.com"]; !ok {
+		t.Fatalf("Expected users-groups-by-id@openssh.com to be advertised, got %v", raw.Extensions)
+	}
+
+	uids := binary.BigEndian.AppendUint32(nil, stat.UID)
+	uids = binary.BigEndian.AppendUint32(uids, 4242)
+	gids := binary.BigEndian.AppendUint32(nil, stat.GID)
+	reply, err := raw.Extended("users-groups-by-id@openssh.com", string(uids), string(gids))
+	if err != nil {
+		t.Fatalf("Failed to look up ids: %v", err)
+	}
+
+	// unknown ids get an empty name
+	users := appendName(appendName(nil, "admin"), "")
+	groups := appendName(nil, "admin")
+	want := appendName(appendName(nil, string(users)), string(groups))
+	if !bytes.Equal(reply, want) {
+		t.Fatalf("Expected reply %q, got %q", want, reply)
+	}
+}
+
+// appendName appends a string in the encoding of the sftp protocol
+func appendName(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func (ts *TestSuite) TestErrorStatus(t *testing.T) {
+	gw := ts.GetGateway("admin")
+	err := gw.CreateFolder("/Admin/ErrorDir")
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	err = gw.CreateFile("/Admin/ErrorDir/File.txt", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("admin")
+	defer cleanup()
+
+	// the client turns the status codes for missing files and refused operations into os errors,
+	// other codes are kept along with the message
+	tests := []struct {
+		name    string
+		op      func() error
+		want    error
+		message string
+	}{
+		{"missing file", func() error { _, err := client.Stat("/Admin/Missing.txt"); return err }, os.ErrNotExist, ""},
+		{"existing directory", func() error { return client.Mkdir("/Admin/ErrorDir") }, pkgsftp.ErrSSHFxFailure, "file exists"},
+		{"directory not empty", func() error { return client.RemoveDirectory("/Admin/ErrorDir") }, pkgsftp.ErrSSHFxFailure, "directory not empty"},
+		{"inside the trash", func() error { return client.Mkdir("/Admin/.trash/New") }, os.ErrPermission, ""},
+		{"symbolic link", func() error { return client.Symlink("/Admin/ErrorDir/File.txt", "/Admin/Link.txt") }, pkgsftp.ErrSSHFxOpUnsupported, "not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op()
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+
+			var statusErr *pkgsftp.StatusError
+			if errors.As(err, &statusErr) {
+				if statusErr.FxCode() != tt.want {
+					t.Fatalf("Expected status %v, got %v", tt.want, err)
+				}
+			} else if !errors.Is(err, tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, err)
+			}
+
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Fatalf("Expected message %q, got %v", tt.message, err)
+			}
+		})
+	}
+}
+
+func (ts *TestSuite) TestChroot(t *testing.T) {
+	// the server confines dennis to the Inbox directory of their personal space
+	gw := ts.GetGateway("dennis")
+	home := "/" + gw.GetUser().GetDisplayName()
+
+	if err := gw.CreateFolder(home + "/Inbox"); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := gw.CreateFile(home+"/Inbox/Inside.txt", []byte("inside")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := gw.CreateFile(home+"/Outside.txt", []byte("outside")); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	client, cleanup := ts.GetSFTPClient("dennis")
+	defer cleanup()
+
+	for _, dir := range []string{"/", "/..", "/../..", "../../.."} {
+		entries, err := client.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to list %s: %v", dir, err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "Inside.txt" {
+			t.Fatalf("Expected only the chroot directory in %s, got %v", dir, entries)
+		}
+	}
+
+	resolved, err := client.RealPath("../..")
+	if err != nil {
+		t.Fatalf("Failed to resolve path: %v", err)
+	}
+	if resolved != "/" {
+		t.Fatalf("Expected the parent of the root to be the root, got %s", resolved)
+	}
+
+	for _, p := range []string{"/../Outside.txt", "/../../Admin", "/Shares"} {
+		if _, err := client.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected %s to be missing, got %v", p, err)
+		}
+	}
+
+	// rename and copy targets above the root end up within the chroot directory
+	if err := client.Rename("/Inside.txt", "/../Moved.txt"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	if _, err := gw.Stat(home + "/Inbox/Moved.txt"); err != nil {
+		t.Fatalf("Expected the renamed file in the chroot directory: %v", err)
+	}
+
+	if err := client.Rename("/Moved.txt", "/../Admin/Moved.txt"); err == nil {
+		t.Fatalf("Expected a rename into another space to fail")
+	}
+
+	raw, err := client.NewRawSession()
+	if err != nil {
+		t.Fatalf("Failed to start raw session: %v", err)
+	}
+	defer raw.Close()
+
+	_, err = raw.Extended("copy-file", "/../Moved.txt", "/../../Outside.txt", true)
+	if err != nil {
+		t.Fatalf("Failed to copy file: %v", err)
+	}
+
+	copied, err := gw.Download(home + "/Inbox/Outside.txt")
+	if err != nil {
+		t.Fatalf("Expected the copy in the chroot directory: %v", err)
+	}
+	if string(copied) != "inside" {
+		t.Fatalf("Unexpected content of copy: %q", copied)
+	}
+
+	outside, err := gw.Download(home + "/Outside.txt")
+	if err != nil {
+		t.Fatalf("Failed to download file: %v", err)
+	}
+	if string(outside) != "outside" {
+		t.Fatalf("Expected the file outside the chroot to be untouched, got %q", outside)
+	}
+}
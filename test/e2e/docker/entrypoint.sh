@@ -16,22 +16,44 @@ cleanup() {
         echo "Stopping opencloud-sftp (PID: $PID2)"
         kill $PID2
     fi
+    if [[ -n $PID3 ]] && kill -0 $PID3 2>/dev/null; then
+        echo "Stopping opencloud-sftp with atomic uploads (PID: $PID3)"
+        kill $PID3
+    fi
     exit 0
 }
 
 # Set up signal handlers for cleanup
 trap cleanup SIGTERM SIGINT
 
+# The demo users give the tests someone to share with. Shares are accepted by the tests themselves.
+export IDM_CREATE_DEMO_USERS=true
+export FRONTEND_AUTO_ACCEPT_SHARES=false
+
 echo "Starting opencloud server..."
 /usr/local/bin/opencloud server &
 PID1=$!
 echo "opencloud started with PID: $PID1"
 sleep 5
 
+# dennis is confined to a directory of their personal space, which the chroot test creates
 echo "Starting opencloud-sftp server..."
+OCSFTP_UPLOADS_RESUMABLE=true \
+OCSFTP_CHROOT_USERS=dennis \
+OCSFTP_CHROOT_PATH=/Inbox \
 /usr/local/bin/opencloud-sftp server &
 PID2=$!
 echo "opencloud-sftp started with PID: $PID2"
+
+# A second server publishes uploads atomically. It keeps its files apart, as leftovers are removed on start.
+echo "Starting opencloud-sftp server with atomic uploads..."
+OCSFTP_ADDRESS=127.0.0.1:2223 \
+OCSFTP_UPLOADS_ATOMIC=true \
+OCSFTP_UPLOADS_TEMP_DIR=/tmp/opencloud-sftp-atomic/tmp \
+OCSFTP_UPLOADS_STAGING_DIR=/tmp/opencloud-sftp-atomic/staging \
+/usr/local/bin/opencloud-sftp server &
+PID3=$!
+echo "opencloud-sftp with atomic uploads started with PID: $PID3"
 sleep 5
 
 # Check if background processes are still running
@@ -45,4 +67,9 @@ if ! kill -0 $PID2 2>/dev/null; then
     exit 1
 fi
 
+if ! kill -0 $PID3 2>/dev/null; then
+    echo "Error: Failed to start opencloud-sftp with atomic uploads. Exited early?"
+    exit 1
+fi
+
 make test-e2e
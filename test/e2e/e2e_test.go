@@ -84,7 +84,19 @@ func (ts *TestSuite) GetGateway(uid string) *gateway.Client {
 }
 
 func (ts *TestSuite) GetSFTPClient(uid string) (*sftp.Client, func()) {
-	sc, err := ts.sftpClientFactory.NewClient(uid)
+	return ts.getSFTPClient(uid, ts.cfg.SFTPClient.Address)
+}
+
+// GetAtomicSFTPClient is like GetSFTPClient, for the server which publishes uploads atomically
+func (ts *TestSuite) GetAtomicSFTPClient(uid string) (*sftp.Client, func()) {
+	return ts.getSFTPClient(uid, ts.cfg.SFTPClient.AtomicAddress)
+}
+
+func (ts *TestSuite) getSFTPClient(uid, addr string) (*sftp.Client, func()) {
+	// the public key of the user is deployed to their home
+	ts.GetGateway(uid)
+
+	sc, err := ts.sftpClientFactory.NewClientAt(uid, addr)
 	if err != nil {
 		log.Fatalf("Failed to create SFTP client: %v", err)
 	}
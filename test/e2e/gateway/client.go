@@ -11,16 +11,21 @@ import (
 	"github.com/IljaN/opencloud-sftp/pkg/keygen"
 	"github.com/IljaN/opencloud-sftp/pkg/vfs/spacelookup"
 	gateway "github.com/cs3org/go-cs3apis/cs3/gateway/v1beta1"
+	grouppb "github.com/cs3org/go-cs3apis/cs3/identity/group/v1beta1"
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 	rpc "github.com/cs3org/go-cs3apis/cs3/rpc/v1beta1"
+	collaboration "github.com/cs3org/go-cs3apis/cs3/sharing/collaboration/v1beta1"
 	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
 	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
 	"github.com/opencloud-eu/opencloud/pkg/registry"
 	"github.com/opencloud-eu/opencloud/pkg/shared"
+	"github.com/opencloud-eu/reva/v2/pkg/conversions"
 	ctxpkg "github.com/opencloud-eu/reva/v2/pkg/ctx"
 	"github.com/opencloud-eu/reva/v2/pkg/rgrpc/todo/pool"
 	"github.com/opencloud-eu/reva/v2/pkg/storagespace"
+	"github.com/opencloud-eu/reva/v2/pkg/utils"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"io"
 	"net/http"
 	"path"
@@ -511,6 +516,98 @@ func (c *Client) Stat(absolutePath string) (*provider.ResourceInfo, error) {
 
 }
 
+// Download returns the content of a file
+func (c *Client) Download(absolutePath string) ([]byte, error) {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	spacesRes, err := gw.ListStorageSpaces(c.ctx, &provider.ListStorageSpacesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage spaces: %w", err)
+	}
+
+	if spacesRes.Status.Code != rpc.Code_CODE_OK {
+		return nil, fmt.Errorf("list storage spaces failed with status: %s", spacesRes.Status.Message)
+	}
+
+	targetSpace, relPath, err := spacelookup.FindSpaceForPath(absolutePath, spacesRes.GetStorageSpaces())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find storage space for path %s: %w", absolutePath, err)
+	}
+
+	if targetSpace == nil {
+		return nil, fmt.Errorf("no suitable storage space found")
+	}
+
+	resourceId, err := storagespace.ParseID(targetSpace.GetId().GetOpaqueId())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage space ID: %w", err)
+	}
+
+	fileRef := &provider.Reference{
+		ResourceId: &resourceId,
+		Path:       relPath,
+	}
+
+	dlRes, err := gw.InitiateFileDownload(c.ctx, &provider.InitiateFileDownloadRequest{
+		Ref: fileRef,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initiate download failed: %w", err)
+	}
+
+	if dlRes.Status.Code != rpc.Code_CODE_OK {
+		return nil, fmt.Errorf("initiate download failed with status: %s", dlRes.Status.Message)
+	}
+
+	var downloadEndpoint, downloadToken string
+	for _, proto := range dlRes.GetProtocols() {
+		if proto.GetProtocol() == "simple" || proto.GetProtocol() == "spaces" {
+			downloadEndpoint = proto.GetDownloadEndpoint()
+			downloadToken = proto.GetToken()
+			break
+		}
+	}
+
+	if downloadEndpoint == "" {
+		return nil, fmt.Errorf("no suitable download protocol found")
+	}
+
+	httpReq, err := http.NewRequest("GET", downloadEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Add("X-Access-Token", c.token)
+	if downloadToken != "" {
+		httpReq.Header.Add("X-Reva-Transfer", downloadToken)
+	}
+
+	hclient := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true, // TODO: make configurable
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	httpResp, err := hclient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("download request failed: %w", err)
+	}
+
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed with status %d", httpResp.StatusCode)
+	}
+
+	return io.ReadAll(httpResp.Body)
+}
+
 func (c *Client) DeployPublicKey(kp *keygen.KeyPair) error {
 	gw, err := c.gwSelector.Next()
 	if err != nil {
@@ -598,6 +695,257 @@ func (c *Client) ClearPersonalSpace() error {
 	return nil
 }
 
+// ShareWith shares the resource at absolutePath with the user of the given name. The share is read-only
+// unless editor is set.
+func (c *Client) ShareWith(absolutePath, username string, editor bool) error {
+	user, err := c.userByName(username)
+	if err != nil {
+		return err
+	}
+
+	return c.share(absolutePath, &provider.Grantee{
+		Type: provider.GranteeType_GRANTEE_TYPE_USER,
+		Id:   &provider.Grantee_UserId{UserId: user.GetId()},
+	}, editor)
+}
+
+// ShareWithGroup shares the resource at absolutePath with the group of the given id, like ShareWith
+func (c *Client) ShareWithGroup(absolutePath, groupID string, editor bool) error {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	groupRes, err := gw.GetGroupByClaim(c.ctx, &grouppb.GetGroupByClaimRequest{
+		Claim:               "group_id",
+		Value:               groupID,
+		SkipFetchingMembers: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get group %s: %w", groupID, err)
+	}
+
+	if groupRes.Status.Code != rpc.Code_CODE_OK {
+		return fmt.Errorf("get group failed with status: %s", groupRes.Status.Message)
+	}
+
+	return c.share(absolutePath, &provider.Grantee{
+		Type: provider.GranteeType_GRANTEE_TYPE_GROUP,
+		Id:   &provider.Grantee_GroupId{GroupId: groupRes.GetGroup().GetId()},
+	}, editor)
+}
+
+// UserGroups returns the ids of the groups the user of the given name is a member of
+func (c *Client) UserGroups(username string) ([]string, error) {
+	user, err := c.userByName(username)
+	if err != nil {
+		return nil, err
+	}
+
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	res, err := gw.GetUserGroups(c.ctx, &userpb.GetUserGroupsRequest{UserId: user.GetId()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups of %s: %w", username, err)
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return nil, fmt.Errorf("get user groups failed with status: %s", res.Status.Message)
+	}
+
+	return res.GetGroups(), nil
+}
+
+// AcceptShares accepts every pending share of the resource received by the authenticated user,
+// all of them mounted at mountPoint
+func (c *Client) AcceptShares(resourceID *provider.ResourceId, mountPoint string) error {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	listRes, err := gw.ListReceivedShares(c.ctx, &collaboration.ListReceivedSharesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list received shares: %w", err)
+	}
+
+	if listRes.Status.Code != rpc.Code_CODE_OK {
+		return fmt.Errorf("list received shares failed with status: %s", listRes.Status.Message)
+	}
+
+	for _, rs := range listRes.GetShares() {
+		if rs.GetState() != collaboration.ShareState_SHARE_STATE_PENDING ||
+			!utils.ResourceIDEqual(rs.GetShare().GetResourceId(), resourceID) {
+			continue
+		}
+
+		res, err := gw.UpdateReceivedShare(c.ctx, &collaboration.UpdateReceivedShareRequest{
+			Share: &collaboration.ReceivedShare{
+				Share:      rs.GetShare(),
+				State:      collaboration.ShareState_SHARE_STATE_ACCEPTED,
+				MountPoint: &provider.Reference{Path: mountPoint},
+			},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"state", "mount_point"}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to accept share: %w", err)
+		}
+
+		if res.Status.Code != rpc.Code_CODE_OK {
+			return fmt.Errorf("accept share failed with status: %s", res.Status.Message)
+		}
+	}
+
+	return nil
+}
+
+// userByName looks up the user of the given name
+func (c *Client) userByName(username string) (*userpb.User, error) {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	userRes, err := gw.GetUserByClaim(c.ctx, &userpb.GetUserByClaimRequest{
+		Claim:                  "username",
+		Value:                  username,
+		SkipFetchingUserGroups: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user %s: %w", username, err)
+	}
+
+	if userRes.Status.Code != rpc.Code_CODE_OK {
+		return nil, fmt.Errorf("get user failed with status: %s", userRes.Status.Message)
+	}
+
+	return userRes.GetUser(), nil
+}
+
+// share shares the resource at absolutePath with the grantee, read-only unless editor is set
+func (c *Client) share(absolutePath string, grantee *provider.Grantee, editor bool) error {
+	info, err := c.Stat(absolutePath)
+	if err != nil {
+		return err
+	}
+
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	role := conversions.NewViewerRole()
+	switch {
+	case editor && info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER:
+		role = conversions.NewEditorRole()
+	case editor:
+		role = conversions.NewFileEditorRole()
+	}
+
+	res, err := gw.CreateShare(c.ctx, &collaboration.CreateShareRequest{
+		ResourceInfo: info,
+		Grant: &collaboration.ShareGrant{
+			Grantee: grantee,
+			Permissions: &collaboration.SharePermissions{
+				Permissions: role.CS3ResourcePermissions(),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create share: %w", err)
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return fmt.Errorf("create share failed with status: %s", res.Status.Message)
+	}
+
+	return nil
+}
+
+// CreateProjectSpace creates a project space managed by the authenticated user
+func (c *Client) CreateProjectSpace(name string) error {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	res, err := gw.CreateStorageSpace(c.ctx, &provider.CreateStorageSpaceRequest{
+		Type:  "project",
+		Name:  name,
+		Owner: c.user,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create project space: %w", err)
+	}
+
+	if res.Status.Code != rpc.Code_CODE_OK {
+		return fmt.Errorf("create project space failed with status: %s", res.Status.Message)
+	}
+
+	return nil
+}
+
+// DeleteProjectSpace disables and purges the project space with the given name
+func (c *Client) DeleteProjectSpace(name string) error {
+	return c.deleteProjectSpace(name, true)
+}
+
+// DisableProjectSpace disables the project space with the given name, which keeps it in the trash
+func (c *Client) DisableProjectSpace(name string) error {
+	return c.deleteProjectSpace(name, false)
+}
+
+// deleteProjectSpace disables the project spaces with the given name, and purges them if asked to
+func (c *Client) deleteProjectSpace(name string, purge bool) error {
+	gw, err := c.gwSelector.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get gateway client: %w", err)
+	}
+
+	spacesRes, err := gw.ListStorageSpaces(c.ctx, &provider.ListStorageSpacesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list storage spaces: %w", err)
+	}
+
+	for _, spc := range spacesRes.GetStorageSpaces() {
+		if spc.GetName() != name || spc.GetSpaceType() != "project" {
+			continue
+		}
+
+		// the first request disables the space, the second one purges it
+		steps := []bool{false}
+		if utils.ReadPlainFromOpaque(spc.GetOpaque(), "trashed") == "trashed" {
+			steps = nil
+		}
+		if purge {
+			steps = append(steps, true)
+		}
+
+		for _, purge := range steps {
+			req := &provider.DeleteStorageSpaceRequest{Id: spc.GetId()}
+			if purge {
+				req.Opaque = &types.Opaque{Map: map[string]*types.OpaqueEntry{
+					"purge": {Decoder: "plain", Value: []byte("true")},
+				}}
+			}
+
+			res, err := gw.DeleteStorageSpace(c.ctx, req)
+			if err != nil {
+				return fmt.Errorf("failed to delete project space: %w", err)
+			}
+
+			if res.Status.Code != rpc.Code_CODE_OK {
+				return fmt.Errorf("delete project space failed with status: %s", res.Status.Message)
+			}
+		}
+	}
+
+	return nil
+}
+
 // CreateHome creates a new home for the authenticated user
 func (c *Client) CreateHome() error {
 	gw, err := c.gwSelector.Next()
@@ -3,12 +3,17 @@
 package sftp
 
 import (
+	"bytes"
+	"io"
+
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
-	Address        string `env:"ADDR" envDefault:"127.0.1.1:2222"`
+	Address string `env:"ADDR" envDefault:"127.0.1.1:2222"`
+	// AtomicAddress is the address of a server which publishes uploads atomically
+	AtomicAddress  string `env:"ATOMIC_ADDR" envDefault:"127.0.1.1:2223"`
 	PrivateKeyPath string `env:"KEY_PATH"`
 }
 
@@ -33,3 +38,44 @@ func (c *Client) Close() error {
 
 	return nil
 }
+
+// Run executes a command through an ssh exec request and returns its output.
+// A non-zero exit status is returned as *ssh.ExitError.
+func (c *Client) Run(cmd string) (string, string, error) {
+	sess, err := c.SSHClient.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+
+	err = sess.Run(cmd)
+	return stdout.String(), stderr.String(), err
+}
+
+// Exec starts a command through an ssh exec request and returns pipes to talk to it
+func (c *Client) Exec(cmd string) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+	sess, err := c.SSHClient.NewSession()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := sess.Start(cmd); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return sess, stdin, stdout, nil
+}
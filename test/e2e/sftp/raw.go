@@ -0,0 +1,239 @@
+//go:build e2e
+
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Open flags of the sftp protocol
+const (
+	FxfRead  = 0x01
+	FxfWrite = 0x02
+	FxfCreat = 0x08
+	FxfTrunc = 0x10
+)
+
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpName          = 104
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// StatusError is a status reply other than OK
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.Code, e.Message)
+}
+
+// RawSession speaks the sftp protocol on its own channel, for requests the pkg/sftp client does not send
+type RawSession struct {
+	w      io.WriteCloser
+	r      io.Reader
+	nextID uint32
+
+	// Extensions holds the extensions advertised by the server
+	Extensions map[string]string
+}
+
+// NewRawSession starts an sftp session and exchanges the version
+func (c *Client) NewRawSession() (*RawSession, error) {
+	sess, err := c.SSHClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+
+	s := &RawSession{w: w, r: r, Extensions: map[string]string{}}
+
+	if err := s.send(binary.BigEndian.AppendUint32([]byte{fxpInit}, 3)); err != nil {
+		return nil, err
+	}
+
+	typ, body, err := s.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("unexpected packet type %d", typ)
+	}
+
+	for rest := body[4:]; len(rest) > 0; {
+		var name, data string
+		if name, rest, err = readString(rest); err != nil {
+			return nil, err
+		}
+		if data, rest, err = readString(rest); err != nil {
+			return nil, err
+		}
+		s.Extensions[name] = data
+	}
+
+	return s, nil
+}
+
+// Open opens a file and returns its handle
+func (s *RawSession) Open(path string, pflags uint32) (string, error) {
+	typ, body, err := s.request(fxpOpen, path, pflags, uint32(0))
+	if err != nil {
+		return "", err
+	}
+	if typ != fxpHandle {
+		return "", fmt.Errorf("unexpected packet type %d", typ)
+	}
+
+	handle, _, err := readString(body)
+	return handle, err
+}
+
+// CloseHandle closes a handle
+func (s *RawSession) CloseHandle(handle string) error {
+	_, _, err := s.request(fxpClose, handle)
+	return err
+}
+
+// Extended sends an extended request with the given fields and returns the data of the extended reply, if any
+func (s *RawSession) Extended(name string, fields ...any) ([]byte, error) {
+	typ, body, err := s.request(fxpExtended, append([]any{name}, fields...)...)
+	if err != nil {
+		return nil, err
+	}
+	if typ == fxpExtendedReply {
+		return body, nil
+	}
+
+	return nil, nil
+}
+
+// Name sends an extended request which is answered with a single name, like expand-path@openssh.com, and returns the name
+func (s *RawSession) Name(name string, fields ...any) (string, error) {
+	typ, body, err := s.request(fxpExtended, append([]any{name}, fields...)...)
+	if err != nil {
+		return "", err
+	}
+	if typ != fxpName || len(body) < 4 {
+		return "", fmt.Errorf("unexpected packet type %d", typ)
+	}
+
+	result, _, err := readString(body[4:])
+	return result, err
+}
+
+// Close ends the session
+func (s *RawSession) Close() error {
+	return s.w.Close()
+}
+
+// request sends a request with the given fields and waits for the reply. Status replies other than OK are returned as error.
+func (s *RawSession) request(typ byte, fields ...any) (byte, []byte, error) {
+	s.nextID++
+	id := s.nextID
+
+	pkt := binary.BigEndian.AppendUint32([]byte{typ}, id)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			pkt = binary.BigEndian.AppendUint32(pkt, uint32(len(v)))
+			pkt = append(pkt, v...)
+		case uint32:
+			pkt = binary.BigEndian.AppendUint32(pkt, v)
+		case uint64:
+			pkt = binary.BigEndian.AppendUint64(pkt, v)
+		case bool:
+			if v {
+				pkt = append(pkt, 1)
+			} else {
+				pkt = append(pkt, 0)
+			}
+		default:
+			return 0, nil, fmt.Errorf("unsupported field type %T", f)
+		}
+	}
+
+	if err := s.send(pkt); err != nil {
+		return 0, nil, err
+	}
+
+	replyType, body, err := s.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(body) < 4 || binary.BigEndian.Uint32(body) != id {
+		return 0, nil, fmt.Errorf("unexpected reply")
+	}
+	body = body[4:]
+
+	if replyType == fxpStatus {
+		if len(body) < 4 {
+			return 0, nil, fmt.Errorf("short status reply")
+		}
+		code := binary.BigEndian.Uint32(body)
+		if code != 0 {
+			msg, _, _ := readString(body[4:])
+			return 0, nil, &StatusError{Code: code, Message: msg}
+		}
+	}
+
+	return replyType, body, nil
+}
+
+func (s *RawSession) send(body []byte) error {
+	_, err := s.w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...))
+	return err
+}
+
+func (s *RawSession) recv() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	pkt := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(s.r, pkt); err != nil {
+		return 0, nil, err
+	}
+	if len(pkt) == 0 {
+		return 0, nil, fmt.Errorf("empty packet")
+	}
+
+	return pkt[0], pkt[1:], nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("short string")
+	}
+
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil, fmt.Errorf("short string")
+	}
+
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
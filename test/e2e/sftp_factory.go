@@ -25,6 +25,11 @@ func NewClientFactory(sftpCfg sftp.Config, gwCfg gateway.Config) *ClientFactory
 }
 
 func (c *ClientFactory) NewClient(uid string) (*sftp.Client, error) {
+	return c.NewClientAt(uid, c.sftConfig.Address)
+}
+
+// NewClientAt creates a client for the server listening at addr
+func (c *ClientFactory) NewClientAt(uid, addr string) (*sftp.Client, error) {
 	var keyPair *keygen.KeyPair
 	var err error
 
@@ -58,7 +63,7 @@ func (c *ClientFactory) NewClient(uid string) (*sftp.Client, error) {
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	sshClient, err := ssh.Dial("tcp", c.sftConfig.Address, sshClientConfig)
+	sshClient, err := ssh.Dial("tcp", addr, sshClientConfig)
 	if err != nil {
 		return nil, err
 	}